@@ -2,32 +2,47 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/pusher/crank/src/crank"
 	"github.com/pusher/crank/src/netutil"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var (
-	bind    string
-	conf    string
-	ctl     string
-	prefix  string
-	name    string
-	version bool
+	apps     string
+	auth     string
+	bind     string
+	conf     string
+	ctl      string
+	prefix   string
+	name     string
+	history  int
+	version  bool
+	webhooks string
+
+	tlsProxies []*netutil.TLSProxy
+	upgrade    *crank.UpgradeState
 
 	build string
 )
 
 func init() {
+	flag.StringVar(&apps, "apps", os.Getenv("CRANK_APPS"), "path to a file describing multiple apps to run, instead of -bind and -conf")
+	flag.StringVar(&auth, "auth", os.Getenv("CRANK_AUTH"), "path to the control socket users and permissions. Everybody who can reach the socket has all the permissions without it")
 	flag.StringVar(&bind, "bind", os.Getenv("CRANK_BIND"), "external address to bind (e.g. 'tcp://:80')")
 	flag.StringVar(&conf, "conf", os.Getenv("CRANK_CONF"), "path to the process config file")
 	flag.StringVar(&ctl, "ctl", os.Getenv("CRANK_CTL"), "rpc socket address")
 	flag.StringVar(&prefix, "prefix", crank.Prefix(os.Getenv("CRANK_PREFIX")), "crank runtime directory")
 	flag.StringVar(&name, "name", os.Getenv("CRANK_NAME"), "crank process name. Used to infer -conf and -ctl if specified.")
+	flag.IntVar(&history, "history", crank.DEFAULT_CONFIG_HISTORY, "number of successful configs to keep for rollbacks")
 	flag.BoolVar(&version, "version", false, "show version")
+	flag.StringVar(&webhooks, "webhooks", os.Getenv("CRANK_WEBHOOKS"), "path to a file describing the webhooks notified of the lifecycle events")
 }
 
 func main() {
@@ -38,34 +53,56 @@ func main() {
 		return
 	}
 
-	conf = crank.DefaultConf(conf, prefix, name)
 	ctl = crank.DefaultCtl(ctl, prefix, name)
-
-	if bind == "" {
-		log.Fatal("Missing required flag: bind")
-	}
 	if ctl == "" {
 		log.Fatal("Missing required flag: ctl or name")
 	}
-	if conf == "" {
-		log.Fatal("Missing required flag: conf or name")
+
+	netutil.TakeSystemdListeners()
+
+	var err error
+	if upgrade, err = crank.LoadUpgradeState(); err != nil {
+		log.Fatal("Could not load the upgrade state: ", err)
 	}
 
-	socket, err := netutil.BindURI(bind)
-	if err != nil {
-		log.Fatal("bind socket failed: ", err)
+	supervisor := crank.NewSupervisor(build)
+
+	if apps != "" {
+		config, err := crank.LoadAppsConfig(apps)
+		if err != nil {
+			log.Fatal("Could not load the apps: ", err)
+		}
+		for appName, app := range config.Apps {
+			manager := newManager(appName, app.Bind, crank.DefaultConf(app.Conf, prefix, appName))
+			// Other apps keep running
+			manager.KeepAlive(true)
+			supervisor.Add(appName, app.Bind, manager)
+		}
+	} else {
+		conf = crank.DefaultConf(conf, prefix, name)
+		if bind == "" {
+			log.Fatal("Missing required flag: bind")
+		}
+		if conf == "" {
+			log.Fatal("Missing required flag: conf or name")
+		}
+		supervisor.Add(name, bind, newManager(name, bind, conf))
 	}
 
-	// Make sure the path is writeable
-	f, err := os.OpenFile(conf, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Fatal("Config file not writeable: ", err)
+	var authConfig *crank.AuthConfig
+	if auth != "" {
+		if authConfig, err = crank.LoadAuthConfig(auth); err != nil {
+			log.Fatal("Could not load the auth config: ", err)
+		}
+	} else if network, _, _ := netutil.ParseURI(ctl); strings.HasPrefix(network, "tcp") {
+		log.Println("WARNING: the ctl socket accepts TCP connections without -auth")
 	}
-	f.Close()
 
-	rpcFile, err := netutil.BindURI(ctl)
-	if err != nil {
-		log.Fatal("ctl socket failed: ", err)
+	rpcFile := upgrade.CtlFile()
+	if rpcFile == nil {
+		if rpcFile, err = netutil.BindURI(ctl); err != nil {
+			log.Fatal("ctl socket failed: ", err)
+		}
 	}
 	rpcListener, err := net.FileListener(rpcFile)
 	if err != nil {
@@ -74,16 +111,115 @@ func main() {
 	rpcFile.Close()
 	rpcListener = netutil.UnlinkListener(rpcListener)
 
-	manager := crank.NewManager(build, name, conf, socket)
-	go onSignal(manager.Reload, syscall.SIGHUP)
-	go onSignal(manager.Shutdown, syscall.SIGTERM, syscall.SIGINT)
+	for _, proxy := range tlsProxies {
+		go proxy.Serve()
+	}
 
-	rpc := crank.NewRPCServer(manager)
+	var webhookNotifier *crank.WebhookNotifier
+	if webhooks != "" {
+		config, err := crank.LoadWebhooksConfig(webhooks)
+		if err != nil {
+			log.Fatal("Could not load the webhooks: ", err)
+		}
+		webhookNotifier = crank.NewWebhookNotifier(config)
+		supervisor.Observe(webhookNotifier.Observe)
+	}
+
+	notifier, err := crank.NewSystemdNotifier()
+	if err != nil {
+		log.Println("systemd notifications disabled: ", err)
+	} else if notifier != nil {
+		supervisor.Observe(notifier.Observe)
+		go notifier.Watchdog(supervisor.Ping)
+	}
+
+	supervisor.EnableUpgrade(rpcListener, notifier.Environ()...)
+	if len(tlsProxies) > 0 {
+		// The proxied connections would be lost
+		supervisor.DisableUpgrade(fmt.Errorf("Upgrades are not supported with tls+tcp binds"))
+	}
+
+	go onSignal(func() {
+		for _, proxy := range tlsProxies {
+			if err := proxy.Reload(); err != nil {
+				log.Println(err)
+			}
+		}
+		supervisor.Reload()
+	}, syscall.SIGHUP)
+	var stopped int32 // Once the managers have exited
+	go onSignal(func() {
+		if atomic.LoadInt32(&stopped) == 1 {
+			log.Println("Exiting without waiting for the connections and webhooks")
+			os.Exit(1)
+		}
+		closeTLSProxies()
+		supervisor.Shutdown()
+	}, syscall.SIGTERM, syscall.SIGINT)
+
+	rpc := crank.NewRPCServer(supervisor, authConfig)
 	go rpc.Accept(rpcListener)
 
-	manager.Run() // Blocking
+	supervisor.Run() // Blocking
+	atomic.StoreInt32(&stopped, 1)
 
 	rpcListener.Close()
+	closeTLSProxies()
+	if supervisor.ForcedExit() {
+		log.Println("Bye!")
+		return
+	}
+	rpc.Wait(5 * time.Second)
+	if webhookNotifier != nil {
+		webhookNotifier.Close(10 * time.Second)
+	}
 
 	log.Println("Bye!")
 }
+
+func closeTLSProxies() {
+	for _, proxy := range tlsProxies {
+		proxy.Close()
+	}
+}
+
+func newManager(name, bind, conf string) *crank.Manager {
+	var err error
+	socket := upgrade.Socket(name)
+	if socket == nil {
+		if socket, err = bindSocket(bind); err != nil {
+			log.Fatalf("bind socket failed for %s: %s", name, err)
+		}
+	}
+
+	// Make sure the path is writeable
+	f, err := os.OpenFile(conf, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal("Config file not writeable: ", err)
+	}
+	f.Close()
+
+	manager, err := crank.NewManager(name, conf, history, socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if upgrade != nil {
+		manager.Adopt(upgrade)
+	}
+	return manager
+}
+
+// TLS is terminated by crank, the processes get the plaintext internal socket
+// of the proxy
+func bindSocket(bind string) (*os.File, error) {
+	if !strings.HasPrefix(bind, "tls+") {
+		return netutil.BindURI(bind)
+	}
+
+	proxy, err := netutil.NewTLSProxy(bind)
+	if err != nil {
+		return nil, err
+	}
+	tlsProxies = append(tlsProxies, proxy)
+	return proxy.File()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pusher/crank/src/client"
+)
+
+// Connects to the control socket, using TLS and authenticating with the
+// token if they are configured
+func dial(ctx context.Context, ctl string) (*client.Client, error) {
+	options := &client.Options{Token: token}
+
+	if tlsCA != "" || tlsCert != "" {
+		config, err := clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		options.TLS = config
+	}
+
+	return client.Dial(ctx, ctl, options)
+}
+
+// The server name is filled in by the client
+func clientTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsCA != "" {
+		pem, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", tlsCA)
+		}
+	}
+
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
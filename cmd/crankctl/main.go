@@ -1,30 +1,38 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"net/rpc"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/pusher/crank/src/client"
 	"github.com/pusher/crank/src/crank"
-	"github.com/pusher/crank/src/netutil"
 )
 
-type Command func(*rpc.Client) error
+type Command func(ctx context.Context, c *client.Client, out io.Writer) error
 type CommandSetup func(*flag.FlagSet) Command
 
-type ExitError int
-
-func (e ExitError) Error() string {
-	return fmt.Sprintf("exited with %d", e)
-}
-
 var (
 	commands map[string]CommandSetup
 	flags    *flag.FlagSet
 	ctl      string = os.Getenv("CRANK_CTL")
 	prefix   string = crank.Prefix(os.Getenv("CRANK_PREFIX"))
 	name     string = os.Getenv("CRANK_NAME")
+	app      string = os.Getenv("CRANK_APP")
+	token    string = os.Getenv("CRANK_TOKEN")
+	tlsCA    string = os.Getenv("CRANK_TLS_CA")
+	tlsCert  string = os.Getenv("CRANK_TLS_CERT")
+	tlsKey   string = os.Getenv("CRANK_TLS_KEY")
+	glob     string
+	parallel int = 1
 	version  bool
 
 	build string
@@ -32,10 +40,19 @@ var (
 
 func init() {
 	commands = make(map[string]CommandSetup)
+	commands["apps"] = Apps
+	commands["config"] = Config
+	commands["history"] = History
 	commands["info"] = Info
 	commands["kill"] = Kill
+	commands["pause"] = Pause
 	commands["ps"] = Ps
+	commands["resume"] = Resume
+	commands["rollback"] = Rollback
 	commands["run"] = Run
+	commands["scale"] = Scale
+	commands["shutdown"] = Shutdown
+	commands["upgrade"] = Upgrade
 
 	flags = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flags.Usage = func() {
@@ -47,6 +64,8 @@ func init() {
 		}
 	}
 	defaultFlags(flags)
+	flags.StringVar(&glob, "glob", "", "run the command on every crank whose name matches the pattern, eg: 'api-*'")
+	flags.IntVar(&parallel, "parallel", parallel, "with -glob, number of cranks to run the command on at once. 1 stops on the first failure")
 	flags.BoolVar(&version, "version", false, "show version")
 }
 
@@ -54,6 +73,11 @@ func defaultFlags(flagSet *flag.FlagSet) {
 	flagSet.StringVar(&ctl, "ctl", ctl, "path or address of the control socket")
 	flagSet.StringVar(&prefix, "prefix", prefix, "crank runtime directory")
 	flagSet.StringVar(&name, "name", name, "crank process name. Used to infer -ctl if specified.")
+	flagSet.StringVar(&app, "app", app, "app to control when crank runs multiple apps")
+	flagSet.StringVar(&token, "token", token, "token to authenticate with")
+	flagSet.StringVar(&tlsCA, "tls-ca", tlsCA, "CA certificate to verify crank with. Enables TLS")
+	flagSet.StringVar(&tlsCert, "tls-cert", tlsCert, "client certificate to authenticate with. Enables TLS")
+	flagSet.StringVar(&tlsKey, "tls-key", tlsKey, "key of the client certificate")
 }
 
 func usageError(reason string, args ...interface{}) {
@@ -99,16 +123,29 @@ func main() {
 		usageError("%s", err)
 	}
 
+	if glob != "" {
+		os.Exit(runMulti(command, flags.Args()[1:]))
+	}
+
+	ctx := context.Background()
 	ctl = crank.DefaultCtl(ctl, prefix, name)
-	conn, err := netutil.DialURI(ctl)
+	c, err := dial(ctx, ctl)
 	if err != nil {
 		fail("couldn't connect: %s", err)
 	}
-	client := rpc.NewClient(conn)
 
-	if err = cmd(client); err != nil {
-		fail("command failed: %v", err)
+	if err = cmd(ctx, c, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: command failed: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Returns the exit code of a child if the command reported one
+func exitCode(err error) int {
+	if code, ok := err.(client.ExitError); ok && code > 0 {
+		return int(code)
 	}
+	return 1
 }
 
 func Run(flag *flag.FlagSet) Command {
@@ -118,86 +155,309 @@ func Run(flag *flag.FlagSet) Command {
 	flag.IntVar(&query.Pid, "pid", 0, "Only if the current pid matches")
 	flag.BoolVar(&query.Wait, "wait", false, "Wait for a result")
 	flag.StringVar(&query.Cwd, "cwd", "", "Working directory")
+	flag.BoolVar(&query.Cancel, "cancel", false, "Abort the start in progress, killing its starting processes")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s run [opts] -- [command ...args]:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
-	return func(client *rpc.Client) (err error) {
-		var reply crank.StartReply
-
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
 		// Command and args are passed after
 		if flag.NArg() > 0 {
 			query.Command = flag.Args()
 		}
 
-		if err = client.Call("crank.Run", &query, &reply); err != nil {
-			fmt.Println("Failed to start:", err)
+		query.App = app
+		if query.Cancel {
+			if err = c.Cancel(ctx, app); err != nil {
+				fmt.Fprintln(out, "Failed to cancel:", err)
+				return
+			}
+			fmt.Fprintln(out, "Cancelled successfully")
 			return
 		}
-		if reply.Code > 0 {
-			fmt.Println("Exited with code:", reply.Code)
-			return ExitError(reply.Code)
+		if err = c.Run(ctx, &query); err != nil {
+			if code, ok := err.(client.ExitError); ok {
+				fmt.Fprintln(out, "Exited with code:", int(code))
+			} else {
+				fmt.Fprintln(out, "Failed to start:", err)
+			}
+			return
 		}
 
-		fmt.Println("Started successfully")
+		fmt.Fprintln(out, "Started successfully")
 		return
 	}
 }
 
-func Info(flag *flag.FlagSet) Command {
-	query := crank.InfoQuery{}
+func Scale(flag *flag.FlagSet) Command {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s scale [opts] <replicas>:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
-	return func(client *rpc.Client) (err error) {
-		var reply crank.InfoReply
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		replicas, err := strconv.Atoi(flag.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid number of replicas %q", flag.Arg(0))
+		}
+		return c.Scale(ctx, app, replicas)
+	}
+}
 
-		if err = client.Call("crank.Info", &query, &reply); err != nil {
+func History(flag *flag.FlagSet) Command {
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		restarts, err := c.History(ctx, app)
+		if err != nil {
 			return
 		}
+		for _, r := range restarts {
+			fmt.Fprintln(out, r)
+		}
+		return
+	}
+}
+
+func Rollback(flag *flag.FlagSet) Command {
+	query := crank.RollbackQuery{}
+	var list bool
+	flag.IntVar(&query.Version, "to", 0, "Config version to roll back to, defaults to the previous one")
+	flag.IntVar(&query.Pid, "pid", 0, "Only if the current pid matches")
+	flag.BoolVar(&query.Wait, "wait", false, "Wait for a result")
+	flag.BoolVar(&list, "list", false, "List the available config versions")
+
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		if list {
+			versions, err := c.ConfigVersions(ctx, app)
+			if err != nil {
+				return err
+			}
+			for _, v := range versions {
+				fmt.Fprintf(out, "%d %s %s\n", v.Version, v.Time.Format(time.RFC3339), v.Config)
+			}
+			return nil
+		}
 
-		fmt.Printf("crankctl\n-------\n%s\n\n", crank.GetInfo(build))
-		fmt.Printf("crank\n-----\n%s\n", reply.Info)
+		query.App = app
+		if err = c.Rollback(ctx, &query); err != nil {
+			if code, ok := err.(client.ExitError); ok {
+				fmt.Fprintln(out, "Exited with code:", int(code))
+			} else {
+				fmt.Fprintln(out, "Failed to roll back:", err)
+			}
+			return
+		}
 
+		fmt.Fprintln(out, "Rolled back successfully")
 		return
 	}
 }
 
-func Ps(flag *flag.FlagSet) Command {
-	query := crank.PsQuery{}
-	processQueryFlags(&query.ProcessQuery, flag)
+func Apps(flag *flag.FlagSet) Command {
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		apps, err := c.Apps(ctx)
+		if err != nil {
+			return
+		}
 
-	return func(client *rpc.Client) (err error) {
-		var reply crank.PsReply
+		for _, ai := range apps {
+			fmt.Fprintln(out, ai)
+		}
 
-		if err = client.Call("crank.Ps", &query, &reply); err != nil {
+		return
+	}
+}
+
+func Info(flag *flag.FlagSet) Command {
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		info, err := c.Info(ctx)
+		if err != nil {
 			return
 		}
 
-		for _, pi := range reply.PS {
-			fmt.Println(pi)
-		}
+		fmt.Fprintf(out, "crankctl\n-------\n%s\n\n", crank.GetInfo(build))
+		fmt.Fprintf(out, "crank\n-----\n%s\n", info)
 
 		return
 	}
 }
 
+func Ps(flag *flag.FlagSet) Command {
+	query := crank.PsQuery{}
+	processQueryFlags(&query.ProcessQuery, flag)
+	var format string
+	flag.StringVar(&format, "o", "", "output format: long, json, table or template=<go template>")
+
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		query.App = app
+		ps, err := c.Ps(ctx, &query)
+		if err != nil {
+			return
+		}
+
+		return writeProcessInfos(out, format, ps)
+	}
+}
+
 func Kill(flag *flag.FlagSet) Command {
 	query := crank.KillQuery{}
 	processQueryFlags(&query.ProcessQuery, flag)
 	flag.StringVar(&query.Signal, "signal", "SIGTERM", "signal to send to the processes")
 	flag.BoolVar(&query.Wait, "wait", false, "wait for the target processes to exit")
 
-	return func(client *rpc.Client) (err error) {
-		var reply crank.KillReply
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		query.App = app
+		return c.Kill(ctx, &query)
+	}
+}
+
+func Shutdown(flag *flag.FlagSet) Command {
+	query := crank.ShutdownQuery{}
+	flag.DurationVar(&query.Drain, "drain", 0, "time to wait after closing the socket before stopping the processes")
+	flag.BoolVar(&query.Detach, "detach", false, "leave the processes running")
+	flag.BoolVar(&query.Wait, "wait", false, "wait for the processes to be gone and print how they ended")
+
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		query.App = app
+		processes, err := c.Shutdown(ctx, &query)
+		if err != nil {
+			fmt.Fprintln(out, "Failed to shut down:", err)
+			return
+		}
+
+		if !query.Wait {
+			fmt.Fprintln(out, "Shutting down")
+			return
+		}
+		for _, si := range processes {
+			fmt.Fprintln(out, si)
+		}
+		fmt.Fprintln(out, "Shut down successfully")
+		return
+	}
+}
+
+func Pause(flag *flag.FlagSet) Command {
+	return pauseCommand(flag, (*client.Client).Pause, "Paused")
+}
+
+func Resume(flag *flag.FlagSet) Command {
+	return pauseCommand(flag, (*client.Client).Resume, "Resumed")
+}
+
+type pauseMethod func(*client.Client, context.Context, *client.PauseQuery) ([]int, error)
+
+func pauseCommand(flag *flag.FlagSet, method pauseMethod, done string) Command {
+	query := crank.PauseQuery{}
+	processQueryFlags(&query.ProcessQuery, flag)
+
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		query.App = app
+		pids, err := method(c, ctx, &query)
+		if err != nil {
+			return
+		}
+
+		for _, pid := range pids {
+			fmt.Fprintf(out, "%s pid=%d\n", done, pid)
+		}
+		return
+	}
+}
+
+func Config(flagSet *flag.FlagSet) Command {
+	flagSet.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s config [opts] <get [key] | set key=value... | validate [-file path]>:\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
 
-		return client.Call("crank.Kill", &query, &reply)
+	return func(ctx context.Context, c *client.Client, out io.Writer) (err error) {
+		switch flagSet.Arg(0) {
+		case "get":
+			config, err := c.ConfigGet(ctx, app)
+			if err != nil {
+				return err
+			}
+			return printConfig(out, config, flagSet.Arg(1))
+		case "set":
+			values := make(map[string]string)
+			for _, arg := range flagSet.Args()[1:] {
+				parts := strings.SplitN(arg, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("expected key=value, got %q", arg)
+				}
+				values[parts[0]] = parts[1]
+			}
+			if len(values) == 0 {
+				return fmt.Errorf("nothing to set")
+			}
+
+			config, err := c.ConfigSet(ctx, app, values)
+			if err != nil {
+				return err
+			}
+			return printConfig(out, config, "")
+		case "validate":
+			var path string
+			validateFlags := flag.NewFlagSet(os.Args[0]+" config validate", flag.ExitOnError)
+			validateFlags.StringVar(&path, "file", "", "config file to validate, defaults to the manager's")
+			validateFlags.Parse(flagSet.Args()[1:])
+
+			var data []byte
+			if path != "" {
+				if data, err = ioutil.ReadFile(path); err != nil {
+					return
+				}
+			}
+			if err = c.ConfigValidate(ctx, app, path, data); err != nil {
+				return
+			}
+			fmt.Fprintln(out, "Config is valid")
+			return
+		case "":
+			return fmt.Errorf("config subcommand missing")
+		default:
+			return fmt.Errorf("unknown config subcommand %s", flagSet.Arg(0))
+		}
+	}
+}
+
+// Prints the whole config, or a single key, as JSON
+func printConfig(out io.Writer, config *client.ProcessConfig, key string) error {
+	var v interface{} = config
+
+	if key != "" {
+		field, ok := configField(config, key)
+		if !ok {
+			return fmt.Errorf("unknown config key %s", key)
+		}
+		v = field
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(data))
+	return nil
+}
+
+// Finds a config field by its JSON name
+func configField(config *client.ProcessConfig, key string) (interface{}, bool) {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == key {
+			return v.Field(i).Interface(), true
+		}
 	}
+	return nil, false
 }
 
 func processQueryFlags(query *crank.ProcessQuery, flag *flag.FlagSet) {
 	flag.BoolVar(&query.Starting, "starting", false, "lists the starting process")
 	flag.BoolVar(&query.Ready, "ready", false, "lists the ready process")
 	flag.BoolVar(&query.Stopping, "stopping", false, "lists all processes shutting down")
+	flag.BoolVar(&query.Paused, "paused", false, "lists the paused processes")
 	flag.IntVar(&query.Pid, "pid", 0, "filters to only include that pid")
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pusher/crank/src/crank"
+)
+
+// Result of running a command on one crank instance
+type instanceResult struct {
+	name    string
+	ctl     string
+	output  bytes.Buffer
+	err     error
+	skipped bool
+}
+
+func (r *instanceResult) status() string {
+	switch {
+	case r.skipped:
+		return "skipped"
+	case r.err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+// Finds the control sockets of all the cranks matching the -glob pattern
+func findInstances(prefix, pattern string) ([]*instanceResult, error) {
+	paths, err := filepath.Glob(filepath.Join(crank.Prefix(prefix), pattern+".ctl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	instances := make([]*instanceResult, 0, len(paths))
+	for _, path := range paths {
+		instances = append(instances, &instanceResult{
+			name: strings.TrimSuffix(filepath.Base(path), ".ctl"),
+			ctl:  path,
+		})
+	}
+	return instances, nil
+}
+
+// Runs the command on every matching crank and returns the exit code.
+//
+// With -parallel 1 the instances are done in order and the first failure
+// skips the remaining ones. Otherwise up to -parallel instances run at once
+// and all of them are attempted.
+func runMulti(command string, args []string) int {
+	instances, err := findInstances(prefix, glob)
+	if err != nil {
+		fail("invalid -glob pattern: %s", err)
+	}
+	if len(instances) == 0 {
+		fail("no crank matches %s in %s", glob, crank.Prefix(prefix))
+	}
+
+	// Each instance gets its own parsed command so that they don't share the
+	// query structs.
+	cmds := make([]Command, len(instances))
+	for i := range instances {
+		flagSet := flag.NewFlagSet(os.Args[0]+" "+command, flag.ExitOnError)
+		defaultFlags(flagSet)
+		cmds[i] = commands[command](flagSet)
+		if err = flagSet.Parse(args); err != nil {
+			usageError("%s", err)
+		}
+	}
+
+	if parallel <= 1 {
+		failed := false
+		for i, instance := range instances {
+			if failed {
+				instance.skipped = true
+				continue
+			}
+			instance.err = runInstance(cmds[i], instance)
+			failed = instance.err != nil
+		}
+	} else {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, parallel)
+		for i, instance := range instances {
+			wg.Add(1)
+			go func(cmd Command, instance *instanceResult) {
+				defer wg.Done()
+				slots <- struct{}{}
+				instance.err = runInstance(cmd, instance)
+				<-slots
+			}(cmds[i], instance)
+		}
+		wg.Wait()
+	}
+
+	return reportInstances(instances)
+}
+
+func runInstance(cmd Command, instance *instanceResult) error {
+	ctx := context.Background()
+	c, err := dial(ctx, instance.ctl)
+	if err != nil {
+		return fmt.Errorf("couldn't connect: %s", err)
+	}
+	defer c.Close()
+
+	return cmd(ctx, c, &instance.output)
+}
+
+// Prints the output of each instance followed by a summary table. Returns
+// the exit code of the first failed instance.
+func reportInstances(instances []*instanceResult) (code int) {
+	for _, instance := range instances {
+		if instance.skipped {
+			continue
+		}
+		fmt.Printf("For %s\n", instance.name)
+		os.Stdout.Write(instance.output.Bytes())
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tRESULT\tERROR")
+	for _, instance := range instances {
+		msg := ""
+		if instance.err != nil {
+			msg = instance.err.Error()
+			if code == 0 {
+				code = exitCode(instance.err)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", instance.name, instance.status(), msg)
+	}
+	w.Flush()
+
+	return code
+}
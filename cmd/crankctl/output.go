@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+)
+
+// Writes the process list in one of the formats accepted by `ps -o`:
+// "" (default), "long", "json", "table" or "template=<go template>".
+func writeProcessInfos(w io.Writer, format string, ps []*crank.ProcessInfo) (err error) {
+	switch {
+	case format == "":
+		for _, pi := range ps {
+			fmt.Fprintln(w, pi)
+		}
+	case format == "long":
+		for _, pi := range ps {
+			fmt.Fprintln(w, pi.Long())
+		}
+	case format == "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(ps)
+	case format == "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PID\tCID\tGEN\tSTATE\tUPTIME\tIN STATE\tTIME LEFT\tRSS\tCPU\tSTATUS\tCWD\tCOMMAND")
+		for _, pi := range ps {
+			timeLeft := "-"
+			if pi.TimeLeft > 0 {
+				timeLeft = pi.TimeLeft.Round(time.Second).String()
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%v\t%v\t%s\t%v\t%v\t%s\t%s\t%s\n",
+				pi.Pid, pi.Cid, pi.Generation, pi.State,
+				pi.Uptime.Round(time.Second), pi.StateDuration.Round(time.Second), timeLeft,
+				pi.RSS, pi.CPUTime, pi.Status, pi.Cwd, strings.Join(pi.Command, " "))
+		}
+		err = tw.Flush()
+	case strings.HasPrefix(format, "template="):
+		var tmpl *template.Template
+		tmpl, err = template.New("ps").Parse(strings.TrimPrefix(format, "template="))
+		if err != nil {
+			return
+		}
+		for _, pi := range ps {
+			if err = tmpl.Execute(w, pi); err != nil {
+				return
+			}
+			fmt.Fprintln(w)
+		}
+	default:
+		err = fmt.Errorf("unknown output format %q", format)
+	}
+	return
+}
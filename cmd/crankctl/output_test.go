@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+)
+
+func TestWriteProcessInfos(t *testing.T) {
+	ps := []*crank.ProcessInfo{
+		{
+			Pid: 1234, Cid: 1, Generation: 2, State: "ready",
+			Cwd: "/srv/app", Command: []string{"app", "-port", "80"},
+			Uptime: 90*time.Second + 400*time.Millisecond, StateDuration: 60 * time.Second,
+			Status: "serving", RSS: 3 << 20, CPUTime: 1750 * time.Millisecond,
+		},
+		{
+			Pid: 1240, Cid: 2, Generation: 3, State: "starting",
+			Cwd: "/srv/app", Command: []string{"app"},
+			Uptime: 2 * time.Second, StateDuration: 2 * time.Second, TimeLeft: 28*time.Second + 600*time.Millisecond,
+		},
+	}
+
+	tests := []struct {
+		format string
+		lines  []string
+	}{
+		{"", []string{
+			`1234 1 ready "/srv/app" [app -port 80]`,
+			`1240 2 starting "/srv/app" [app]`,
+		}},
+		{"long", []string{
+			`pid=1234 cid=1 gen=2 state=ready uptime=1m30s state_duration=1m0s rss=3145728 cpu_time=1.75s status="serving" cwd="/srv/app" command=["app" "-port" "80"]`,
+			`pid=1240 cid=2 gen=3 state=starting uptime=2s state_duration=2s time_left=29s rss=0 cpu_time=0s status="" cwd="/srv/app" command=["app"]`,
+		}},
+		{"table", []string{
+			"PID   CID  GEN  STATE     UPTIME  IN STATE  TIME LEFT  RSS         CPU    STATUS   CWD       COMMAND",
+			"1234  1    2    ready     1m30s   1m0s      -          3.00 Mb     1.75s  serving  /srv/app  app -port 80",
+			"1240  2    3    starting  2s      2s        29s        0.00 bytes  0s              /srv/app  app",
+		}},
+		{"template={{.Pid}} {{.State}}", []string{
+			"1234 ready",
+			"1240 starting",
+		}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeProcessInfos(&buf, test.format, ps); err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		if got, want := buf.String(), strings.Join(test.lines, "\n")+"\n"; got != want {
+			t.Errorf("%q: got\n%s\nwant\n%s", test.format, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeProcessInfos(&buf, "json", ps); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*crank.ProcessInfo
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].RSS != 3<<20 || decoded[0].CPUTime != 1750*time.Millisecond || decoded[1].TimeLeft != ps[1].TimeLeft {
+		t.Errorf("unexpected JSON output: %s", buf.Bytes())
+	}
+	if strings.Count(buf.String(), `"time_left"`) != 1 {
+		t.Errorf("time_left should only be set while starting or stopping: %s", buf.Bytes())
+	}
+
+	if err := writeProcessInfos(&buf, "yaml", ps); err == nil {
+		t.Error("unknown formats should be rejected")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pusher/crank/src/client"
+)
+
+func Upgrade(flag *flag.FlagSet) Command {
+	var binary string
+	flag.StringVar(&binary, "binary", "", "path of the new crank binary. Defaults to the running one")
+	timeout := flag.Duration("timeout", 30*time.Second, "how long to wait for the new crank")
+
+	return func(ctx context.Context, c *client.Client, out io.Writer) error {
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		info, err := c.Upgrade(ctx, binary)
+		if err != nil {
+			fmt.Fprintln(out, "Failed to upgrade:", err)
+			return err
+		}
+		fmt.Fprintf(out, "Upgraded successfully\n%s\n", info)
+		return nil
+	}
+}
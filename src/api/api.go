@@ -0,0 +1,341 @@
+// Package api holds the queries, replies and errors of the crank control
+// API. They are shared by crank, which serves the API, and the client
+// package, so that clients don't depend on the daemon.
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// Messages of the errors the API replies with that clients can act on, see
+// the client package. net/rpc only transmits the message.
+const (
+	ERR_SHUTTING_DOWN     = "Manager is shutting down"
+	ERR_STOPPED           = "Manager has stopped"
+	ERR_START_IN_PROGRESS = "New process is already being started"
+	ERR_PID_MISMATCH      = "Passed pid" // Prefix
+)
+
+// AUTHENTICATE
+
+type AuthQuery struct {
+	Token string
+}
+
+type AuthReply struct {
+	Name        string
+	Permissions []string
+}
+
+// Used by the query structs to select the app when crank runs multiple of
+// them. Can be omitted if there is only one.
+type AppQuery struct {
+	App string
+}
+
+// Used by other query structs
+type ProcessQuery struct {
+	AppQuery
+
+	Starting bool
+	Ready    bool
+	Stopping bool
+	Paused   bool
+	Pid      int
+}
+
+// START
+
+type StartQuery struct {
+	AppQuery
+	Command      []string
+	Cwd          string
+	StartTimeout int
+	StopTimeout  int
+	Wait         bool
+	Pid          int
+	// Aborts the start in progress instead
+	Cancel bool
+}
+
+type StartReply struct {
+	Code int
+}
+
+// ROLLBACK
+
+type RollbackQuery struct {
+	AppQuery
+	// Defaults to the version preceding the latest one
+	Version int
+	Wait    bool
+	Pid     int
+}
+
+// SCALE
+
+type ScaleQuery struct {
+	AppQuery
+	Replicas int
+}
+
+type ScaleReply struct{}
+
+type ConfigVersionsQuery struct {
+	AppQuery
+}
+
+type ConfigVersionsReply struct {
+	Versions []*ConfigVersion
+}
+
+// HISTORY
+
+type HistoryQuery struct {
+	AppQuery
+}
+
+type HistoryReply struct {
+	Restarts []*RestartRecord
+}
+
+// Reasons of the restarts
+const (
+	RESTART_STARTUP  = "startup"
+	RESTART_RUN      = "run"
+	RESTART_ROLLBACK = "rollback"
+	RESTART_SCHEDULE = "schedule" // restart_schedule is a cron expression
+	RESTART_MAX_AGE  = "max_age"  // restart_schedule is a duration
+	RESTART_MAX_RSS  = "max_rss"
+)
+
+// Outcomes of the restarts
+const (
+	RESTART_IN_PROGRESS = "in_progress"
+	RESTART_COMPLETED   = "completed"
+	RESTART_FAILED      = "failed"
+)
+
+// Describes a rollout, shown by crankctl history
+type RestartRecord struct {
+	Time       time.Time `json:"time"`
+	Generation int       `json:"generation"`
+	Reason     string    `json:"reason"`
+	Message    string    `json:"message,omitempty"` // Why an automatic restart was triggered
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (self *RestartRecord) String() string {
+	s := fmt.Sprintf("%s gen=%d reason=%s outcome=%s", self.Time.Format(time.RFC3339), self.Generation, self.Reason, self.Outcome)
+	if self.Message != "" {
+		s += fmt.Sprintf(" message=%q", self.Message)
+	}
+	if self.Error != "" {
+		s += fmt.Sprintf(" error=%q", self.Error)
+	}
+	return s
+}
+
+// INFO
+
+type InfoQuery struct{}
+
+type InfoReply struct {
+	Info *Info
+}
+
+type Info struct {
+	NumGoroutine int
+	Version      string
+	Build        string
+}
+
+func (info *Info) String() string {
+	return fmt.Sprintf("goroutines: %d\nversion: %s\nbuild: %s", info.NumGoroutine, info.Version, info.Build)
+}
+
+// APPS
+
+type AppsQuery struct{}
+
+type AppsReply struct {
+	Apps []*AppInfo
+}
+
+type AppInfo struct {
+	Name     string
+	Bind     string
+	Conf     string
+	Starting int
+	Ready    int
+	Stopping int
+	Paused   int
+}
+
+func (ai *AppInfo) String() string {
+	return fmt.Sprintf("name=%s bind=%s conf=%s starting=%d ready=%d stopping=%d paused=%d",
+		ai.Name, ai.Bind, ai.Conf, ai.Starting, ai.Ready, ai.Stopping, ai.Paused)
+}
+
+// PS
+
+type PsQuery struct {
+	ProcessQuery
+}
+
+type PsReply struct {
+	PS []*ProcessInfo
+}
+
+type ProcessInfo struct {
+	Pid           int           `json:"pid"`
+	Cid           int           `json:"cid"`
+	Generation    int           `json:"generation"`
+	State         string        `json:"state"`
+	Cwd           string        `json:"cwd"`
+	Command       []string      `json:"command"`
+	StartTime     time.Time     `json:"start_time"`
+	ReadyTime     time.Time     `json:"ready_time"` // Zero if never ready
+	StateTime     time.Time     `json:"state_time"` // When the current state was entered
+	Uptime        time.Duration `json:"uptime"`
+	StateDuration time.Duration `json:"state_duration"`
+	Status        string        `json:"status"` // Last sd_notify STATUS=
+	RSS           ByteCount     `json:"rss"`
+	CPUTime       time.Duration `json:"cpu_time"`
+	TimeLeft      time.Duration `json:"time_left,omitempty"` // Before being killed for not starting or stopping in time
+}
+
+// The line printed by crankctl ps, kept as it was for the scripts parsing it
+func (pi *ProcessInfo) String() string {
+	return fmt.Sprintf("%d %d %s %#v %v", pi.Pid, pi.Cid, pi.State, pi.Cwd, pi.Command)
+}
+
+// The line printed by crankctl ps -o long
+func (pi *ProcessInfo) Long() string {
+	timeLeft := ""
+	if pi.TimeLeft > 0 {
+		timeLeft = fmt.Sprintf(" time_left=%v", pi.TimeLeft.Round(time.Second))
+	}
+	return fmt.Sprintf("pid=%d cid=%d gen=%d state=%s uptime=%v state_duration=%v%s rss=%d cpu_time=%v status=%q cwd=%q command=%q",
+		pi.Pid, pi.Cid, pi.Generation, pi.State, pi.Uptime.Round(time.Second), pi.StateDuration.Round(time.Second),
+		timeLeft, pi.RSS, pi.CPUTime, pi.Status, pi.Cwd, pi.Command)
+}
+
+type ByteCount int64
+
+var byteExp = map[int]string{
+	0: "bytes",
+	1: "Kb",
+	2: "Mb",
+	3: "Gb",
+}
+
+func (b ByteCount) String() string {
+	var (
+		exp int
+		num float64
+	)
+	for num = float64(b); num > 1024 && exp < 4; exp++ {
+		num /= 1024
+	}
+	return fmt.Sprintf("%0.2f %s", num, byteExp[exp])
+}
+
+// KILL
+
+type KillQuery struct {
+	ProcessQuery
+	Signal string
+	Wait   bool
+}
+
+type KillReply struct{}
+
+// PAUSE
+
+// Without filters, pause selects the ready processes and resume the paused
+// ones
+type PauseQuery struct {
+	ProcessQuery
+}
+
+type PauseReply struct {
+	Pids []int
+}
+
+// CONFIG
+
+type ConfigGetQuery struct {
+	AppQuery
+}
+
+type ConfigSetQuery struct {
+	AppQuery
+	// Serialized field name to JSON or bare string value
+	Values map[string]string
+}
+
+type ConfigReply struct {
+	Config *ProcessConfig
+}
+
+type ConfigValidateQuery struct {
+	AppQuery
+	// File name of the config, only its extension is used to pick the
+	// format. The manager's config file is checked if empty.
+	Name string
+	// Contents of the config. Sent by the client rather than read by crank,
+	// which may see other files.
+	Data []byte
+}
+
+type ConfigValidateReply struct{}
+
+// UPGRADE
+
+type UpgradeQuery struct {
+	// Defaults to the running binary
+	Binary string
+}
+
+type UpgradeReply struct{}
+
+// SHUTDOWN
+
+// How a process ended during a shutdown
+const (
+	SHUTDOWN_EXITED   = "exited"
+	SHUTDOWN_KILLED   = "killed" // Did not stop in time
+	SHUTDOWN_DETACHED = "detached"
+)
+
+type ShutdownQuery struct {
+	// All the apps are shut down if omitted
+	AppQuery
+	// Time to wait after closing the socket before stopping the processes
+	Drain time.Duration
+	// Leaves the processes running
+	Detach bool
+	// Waits for the processes to be gone and replies with a summary
+	Wait bool
+}
+
+type ShutdownReply struct {
+	Processes []*ShutdownProcessInfo
+}
+
+type ShutdownProcessInfo struct {
+	App     string `json:"app"`
+	Pid     int    `json:"pid"`
+	Cid     int    `json:"cid"`
+	Outcome string `json:"outcome"`
+	Code    int    `json:"code"`
+	Error   string `json:"error"`
+}
+
+func (si *ShutdownProcessInfo) String() string {
+	return fmt.Sprintf("app=%s pid=%d cid=%d outcome=%s code=%d err=%q",
+		si.App, si.Pid, si.Cid, si.Outcome, si.Code, si.Error)
+}
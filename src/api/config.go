@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The process config, as stored in the config files. See crank(1) for the
+// meaning of the fields.
+type ProcessConfig struct {
+	Cwd          string   `json:"cwd" yaml:"cwd" toml:"cwd"`
+	Command      []string `json:"command" yaml:"command" toml:"command"`
+	StartTimeout Duration `json:"start_timeout" yaml:"start_timeout" toml:"start_timeout"`
+	StopTimeout  Duration `json:"stop_timeout" yaml:"stop_timeout" toml:"stop_timeout"`
+	// Caps the EXTEND_TIMEOUT_USEC extensions, counted from the start or the
+	// stop of the process. No limit by default.
+	MaxExtendTimeout Duration `json:"max_extend_timeout,omitempty" yaml:"max_extend_timeout,omitempty" toml:"max_extend_timeout,omitzero"`
+	// Number of identical processes sharing the socket. Defaults to 1.
+	Replicas int `json:"replicas,omitempty" yaml:"replicas,omitempty" toml:"replicas,omitzero"`
+	// Number of replicas started at the same time during a restart. Defaults
+	// to 1.
+	RollingBatch int `json:"rolling_batch,omitempty" yaml:"rolling_batch,omitempty" toml:"rolling_batch,omitzero"`
+	// Number of replicas that need to stay ready during a restart. Defaults to
+	// the number of replicas, meaning that the old replicas are only stopped
+	// once their replacement is ready.
+	RollingMinReady int `json:"rolling_min_ready,omitempty" yaml:"rolling_min_ready,omitempty" toml:"rolling_min_ready,omitzero"`
+	// Restricts the changes made through the control socket
+	Policy *ProcessPolicy `json:"policy,omitempty" yaml:"policy,omitempty" toml:"policy,omitempty"`
+	// Commands run around the lifecycle of the processes
+	Hooks *ProcessHooks `json:"hooks,omitempty" yaml:"hooks,omitempty" toml:"hooks,omitempty"`
+	// Keeps a warm standby process that is promoted instead of starting a
+	// new one
+	Standby bool `json:"standby,omitempty" yaml:"standby,omitempty" toml:"standby,omitempty"`
+	// Sent to the standby when it's promoted. Defaults to SIGUSR2.
+	StandbySignal string `json:"standby_signal,omitempty" yaml:"standby_signal,omitempty" toml:"standby_signal,omitempty"`
+	// Restarts the processes periodically. Either a cron expression or the
+	// maximum age of the ready processes, like "24h".
+	RestartSchedule string `json:"restart_schedule,omitempty" yaml:"restart_schedule,omitempty" toml:"restart_schedule,omitempty"`
+	// Restarts the processes once one of them uses more memory
+	MaxRSS ByteSize `json:"max_rss,omitempty" yaml:"max_rss,omitempty" toml:"max_rss,omitzero"`
+	// Automatic restarts are delayed by a random duration up to it
+	RestartJitter Duration `json:"restart_jitter,omitempty" yaml:"restart_jitter,omitempty" toml:"restart_jitter,omitzero"`
+	// What happens to the starts requested while one is in progress. One of
+	// "reject" (the default), "queue" or "coalesce".
+	RestartQueue string `json:"restart_queue,omitempty" yaml:"restart_queue,omitempty" toml:"restart_queue,omitempty"`
+}
+
+func (self *ProcessConfig) String() string {
+	replicas := self.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+	return fmt.Sprintf("cwd=%s command=%v start_timeout=%v stop_timeout=%v replicas=%d", self.Cwd, self.Command, self.StartTimeout, self.StopTimeout, replicas)
+}
+
+// Successfully started configs are kept next to the config file as
+// numbered copies, eg: /var/crank/app.conf.3. Higher numbers are newer.
+type ConfigVersion struct {
+	Version int
+	Time    time.Time
+	Config  *ProcessConfig
+}
+
+// Restricts the changes that control socket users can make to the config,
+// with crankctl run, rollback or config set. Eg in YAML:
+//
+//	policy:
+//	  commands:
+//	    - bin/server --port *
+//	  cwd: /srv/app/releases/*
+//	  overrides: [cwd]
+//
+// The policy itself can only be changed by editing the config file.
+type ProcessPolicy struct {
+	// Allowed commands. The words of a pattern are matched one by one against
+	// the arguments of the command, see path.Match. Any command is allowed if
+	// empty.
+	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty" toml:"commands,omitempty"`
+	// Allowed working directory, see path.Match. Any directory is allowed if
+	// empty.
+	Cwd string `json:"cwd,omitempty" yaml:"cwd,omitempty" toml:"cwd,omitempty"`
+	// Config keys that can be changed, eg: cwd, command, start_timeout.
+	// Nothing can be changed if empty.
+	Overrides []string `json:"overrides,omitempty" yaml:"overrides,omitempty" toml:"overrides,omitempty"`
+}
+
+// Commands run by crank around the lifecycle of the processes. pre_start
+// runs once per restart before any new process is started and aborts the
+// restart if it fails. pre_stop runs before each process is sent SIGTERM.
+// post_ready and post_exit run after each process is ready or has exited and
+// their failures are only logged.
+type ProcessHooks struct {
+	PreStart  *Hook `json:"pre_start,omitempty" yaml:"pre_start,omitempty" toml:"pre_start,omitempty"`
+	PostReady *Hook `json:"post_ready,omitempty" yaml:"post_ready,omitempty" toml:"post_ready,omitempty"`
+	PreStop   *Hook `json:"pre_stop,omitempty" yaml:"pre_stop,omitempty" toml:"pre_stop,omitempty"`
+	PostExit  *Hook `json:"post_exit,omitempty" yaml:"post_exit,omitempty" toml:"post_exit,omitempty"`
+}
+
+type Hook struct {
+	Command []string `json:"command" yaml:"command" toml:"command"`
+	// The hook is killed after it. Defaults to 30s.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitzero"`
+}
+
+// A time.Duration that serializes to a human-readable string like "30s".
+//
+// Plain numbers are also accepted and interpreted as seconds, like the
+// crankctl flags.
+type Duration time.Duration
+
+// Configs saved by previous versions of crank contain nanoseconds, from 1s
+// up. Plain numbers of seconds are only accepted up to a day, anything in
+// between could be either and is rejected rather than guessed.
+const (
+	legacyDurationThreshold = 1e9
+	maxDurationSeconds      = 24 * 60 * 60
+)
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var str string
+	if err = json.Unmarshal(data, &str); err == nil {
+		return d.parse(str)
+	}
+
+	var num json.Number
+	if err = json.Unmarshal(data, &num); err != nil {
+		return fmt.Errorf("Invalid duration %s, expected a string like \"30s\" or a number of seconds", data)
+	}
+	return d.parse(num.String())
+}
+
+func (d *Duration) parse(str string) error {
+	if num, err := strconv.ParseFloat(str, 64); err == nil {
+		switch {
+		case num >= legacyDurationThreshold:
+			*d = Duration(num)
+		case num <= maxDurationSeconds:
+			*d = Duration(num * float64(time.Second))
+		default:
+			return fmt.Errorf("Ambiguous duration %s, write it with a unit like \"30s\"", str)
+		}
+		return nil
+	}
+
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(data []byte) error {
+	return d.parse(string(data))
+}
+
+// TOML hands over integers without going through UnmarshalText
+func (d *Duration) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		return d.parse(v)
+	case int64:
+		return d.parse(strconv.FormatInt(v, 10))
+	case float64:
+		return d.parse(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("Invalid duration %v, expected a string like \"30s\" or a number of seconds", v)
+	}
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// The older form of yaml.Unmarshaler, it doesn't need to import the YAML
+// library
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return fmt.Errorf("Invalid duration, expected a string like \"30s\" or a number of seconds: %s", err)
+	}
+	return d.parse(str)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// A number of bytes that serializes to a human-readable string like "512M".
+// The K, M, G and T suffixes are powers of 1024 and may be followed by "b"
+// or "iB". Plain numbers are bytes.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func (b *ByteSize) parse(str string) error {
+	num := strings.TrimSpace(str)
+	for _, suffix := range []string{"iB", "b", "B"} {
+		if strings.HasSuffix(num, suffix) {
+			num = strings.TrimSuffix(num, suffix)
+			break
+		}
+	}
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(num), unit.suffix) {
+			num = strings.TrimSpace(num[:len(num)-1])
+			multiplier = unit.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid size %q, expected a number of bytes or a string like \"512M\"", str)
+	}
+	*b = ByteSize(value * float64(multiplier))
+	return nil
+}
+
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+func (b *ByteSize) UnmarshalJSON(data []byte) (err error) {
+	var str string
+	if err = json.Unmarshal(data, &str); err == nil {
+		return b.parse(str)
+	}
+	return b.parse(string(data))
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(data []byte) error {
+	return b.parse(string(data))
+}
+
+// TOML hands over integers without going through UnmarshalText
+func (b *ByteSize) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		return b.parse(v)
+	case int64:
+		*b = ByteSize(v)
+		return nil
+	default:
+		return fmt.Errorf("Invalid size %v, expected a number of bytes or a string like \"512M\"", v)
+	}
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+// See Duration.UnmarshalYAML
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return fmt.Errorf("Invalid size, expected a number of bytes or a string like \"512M\": %s", err)
+	}
+	return b.parse(str)
+}
+
+// Uses the largest unit that divides the size
+func (b ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	sizes := map[string]ByteSize{
+		"1024":   1024,
+		"2K":     2048,
+		"1.5Gb":  3 << 29,
+		"100MiB": 100 << 20,
+		"1 T":    1 << 40,
+	}
+	for str, expected := range sizes {
+		var b ByteSize
+		if err := b.parse(str); err != nil || b != expected {
+			t.Error(str, b, err)
+		}
+	}
+	var b ByteSize
+	if err := b.parse("lots"); err == nil {
+		t.Error("invalid sizes should be rejected")
+	}
+	if ByteSize(512<<20).String() != "512M" || ByteSize(1000).String() != "1000" {
+		t.Error(ByteSize(512<<20), ByteSize(1000))
+	}
+}
+
+func TestDuration(t *testing.T) {
+	durations := map[string]time.Duration{
+		`"1m30s"`:      90 * time.Second,
+		`30`:           30 * time.Second,
+		`0.5`:          500 * time.Millisecond,
+		`86400`:        24 * time.Hour,
+		`1000000000`:   time.Second, // legacy nanoseconds
+		`30000000000`:  30 * time.Second,
+		`"2500000000"`: 2500 * time.Millisecond,
+	}
+	for str, expected := range durations {
+		var d Duration
+		if err := d.UnmarshalJSON([]byte(str)); err != nil || time.Duration(d) != expected {
+			t.Error(str, time.Duration(d), err)
+		}
+	}
+	// Either a lot of seconds or a legacy sub-second value
+	for _, str := range []string{`500000000`, `86401`, `"lots"`} {
+		var d Duration
+		if err := d.UnmarshalJSON([]byte(str)); err == nil {
+			t.Error("expected an error for", str, time.Duration(d))
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Package client is a Go client of the crank control API, the one crankctl
+// uses.
+//
+//	c, err := client.Dial(ctx, "/var/crank/app.ctl", nil)
+//	...
+//	err = c.Run(ctx, &client.StartQuery{Wait: true})
+//	if errors.Is(err, client.ErrStartInProgress) {
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pusher/crank/src/api"
+	"github.com/pusher/crank/src/netutil"
+)
+
+// The queries and replies are the ones of the api package
+type (
+	AppQuery            = api.AppQuery
+	ProcessQuery        = api.ProcessQuery
+	StartQuery          = api.StartQuery
+	RollbackQuery       = api.RollbackQuery
+	PsQuery             = api.PsQuery
+	KillQuery           = api.KillQuery
+	PauseQuery          = api.PauseQuery
+	ShutdownQuery       = api.ShutdownQuery
+	AppInfo             = api.AppInfo
+	ConfigVersion       = api.ConfigVersion
+	Info                = api.Info
+	ProcessConfig       = api.ProcessConfig
+	ProcessInfo         = api.ProcessInfo
+	RestartRecord       = api.RestartRecord
+	ShutdownProcessInfo = api.ShutdownProcessInfo
+)
+
+// How often Upgrade checks if crank is back
+const UPGRADE_POLL_INTERVAL = 100 * time.Millisecond
+
+type Options struct {
+	// Authenticates the connections with it, see crank's auth config
+	Token string
+	// Enables TLS. The server name defaults to the host of the URI.
+	TLS *tls.Config
+}
+
+// Client is safe for concurrent use. A lost connection, for example after
+// crank upgraded itself, is replaced on the next call. Only the calls that
+// don't change anything are retried on the new connection, the others
+// return the error.
+//
+// Cancelling the context of a call makes it return but crank carries on
+// with it, see Cancel to abort a start.
+type Client struct {
+	uri     string
+	options Options
+	mutex   sync.Mutex
+	conn    *rpc.Client
+	closed  bool
+}
+
+// Connects to the control socket at the URI, see netutil.DialURI
+func Dial(ctx context.Context, uri string, options *Options) (*Client, error) {
+	c := &Client{uri: uri}
+	if options != nil {
+		c.options = *options
+	}
+	if _, err := c.connection(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (self *Client) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// Starts new processes to replace the current ones. With query.Wait it
+// returns once they are ready, or an ExitError if they exited before.
+func (self *Client) Run(ctx context.Context, query *StartQuery) error {
+	var reply api.StartReply
+	if err := self.call(ctx, "crank.Run", query, &reply); err != nil {
+		return err
+	}
+	if reply.Code > 0 {
+		return ExitError(reply.Code)
+	}
+	return nil
+}
+
+// Aborts the start in progress, killing its starting processes
+func (self *Client) Cancel(ctx context.Context, app string) error {
+	query := &StartQuery{AppQuery: AppQuery{App: app}, Cancel: true}
+	return self.call(ctx, "crank.Run", query, &api.StartReply{})
+}
+
+// Like Run with a previous config version
+func (self *Client) Rollback(ctx context.Context, query *RollbackQuery) error {
+	var reply api.StartReply
+	if err := self.call(ctx, "crank.Rollback", query, &reply); err != nil {
+		return err
+	}
+	if reply.Code > 0 {
+		return ExitError(reply.Code)
+	}
+	return nil
+}
+
+func (self *Client) Scale(ctx context.Context, app string, replicas int) error {
+	query := &api.ScaleQuery{AppQuery: AppQuery{App: app}, Replicas: replicas}
+	return self.call(ctx, "crank.Scale", query, &api.ScaleReply{})
+}
+
+// Returns the config versions that can be rolled back to
+func (self *Client) ConfigVersions(ctx context.Context, app string) ([]*ConfigVersion, error) {
+	var reply api.ConfigVersionsReply
+	err := self.get(ctx, "crank.ConfigVersions", &api.ConfigVersionsQuery{AppQuery: AppQuery{App: app}}, &reply)
+	return reply.Versions, err
+}
+
+// Returns the latest restarts, oldest first
+func (self *Client) History(ctx context.Context, app string) ([]*RestartRecord, error) {
+	var reply api.HistoryReply
+	err := self.get(ctx, "crank.History", &api.HistoryQuery{AppQuery: AppQuery{App: app}}, &reply)
+	return reply.Restarts, err
+}
+
+func (self *Client) Info(ctx context.Context) (*Info, error) {
+	var reply api.InfoReply
+	err := self.get(ctx, "crank.Info", &api.InfoQuery{}, &reply)
+	return reply.Info, err
+}
+
+func (self *Client) Apps(ctx context.Context) ([]*AppInfo, error) {
+	var reply api.AppsReply
+	err := self.get(ctx, "crank.Apps", &api.AppsQuery{}, &reply)
+	return reply.Apps, err
+}
+
+func (self *Client) Ps(ctx context.Context, query *PsQuery) ([]*ProcessInfo, error) {
+	var reply api.PsReply
+	err := self.get(ctx, "crank.Ps", query, &reply)
+	return reply.PS, err
+}
+
+func (self *Client) Kill(ctx context.Context, query *KillQuery) error {
+	return self.call(ctx, "crank.Kill", query, &api.KillReply{})
+}
+
+// Returns the pids of the paused processes
+func (self *Client) Pause(ctx context.Context, query *PauseQuery) ([]int, error) {
+	var reply api.PauseReply
+	err := self.call(ctx, "crank.Pause", query, &reply)
+	return reply.Pids, err
+}
+
+// Returns the pids of the resumed processes
+func (self *Client) Resume(ctx context.Context, query *PauseQuery) ([]int, error) {
+	var reply api.PauseReply
+	err := self.call(ctx, "crank.Resume", query, &reply)
+	return reply.Pids, err
+}
+
+func (self *Client) ConfigGet(ctx context.Context, app string) (*ProcessConfig, error) {
+	var reply api.ConfigReply
+	err := self.get(ctx, "crank.ConfigGet", &api.ConfigGetQuery{AppQuery: AppQuery{App: app}}, &reply)
+	return reply.Config, err
+}
+
+// Changes the config from its serialized field names to JSON or bare string
+// values, and returns the new config
+func (self *Client) ConfigSet(ctx context.Context, app string, values map[string]string) (*ProcessConfig, error) {
+	var reply api.ConfigReply
+	err := self.call(ctx, "crank.ConfigSet", &api.ConfigSetQuery{AppQuery: AppQuery{App: app}, Values: values}, &reply)
+	return reply.Config, err
+}
+
+// Checks a config file, from its name and contents, or the app's if name is
+// empty
+func (self *Client) ConfigValidate(ctx context.Context, app string, name string, data []byte) error {
+	query := &api.ConfigValidateQuery{AppQuery: AppQuery{App: app}, Name: name, Data: data}
+	return self.get(ctx, "crank.ConfigValidate", query, &api.ConfigValidateReply{})
+}
+
+// Replaces crank with the binary, or the running one if empty, and waits
+// for the new crank to answer
+func (self *Client) Upgrade(ctx context.Context, binary string) (*Info, error) {
+	err := self.call(ctx, "crank.Upgrade", &api.UpgradeQuery{Binary: binary}, &api.UpgradeReply{})
+	// crank only replies if the upgrade failed, it drops the connection
+	// otherwise
+	if err != nil && (ctx.Err() != nil || !isConnError(err)) {
+		return nil, err
+	}
+
+	for {
+		info, err := self.Info(ctx)
+		if err == nil {
+			return info, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("crank did not come back after the upgrade: %s", err)
+		case <-time.After(UPGRADE_POLL_INTERVAL):
+		}
+	}
+}
+
+// With query.Wait, returns how the processes ended
+func (self *Client) Shutdown(ctx context.Context, query *ShutdownQuery) ([]*ShutdownProcessInfo, error) {
+	var reply api.ShutdownReply
+	err := self.call(ctx, "crank.Shutdown", query, &reply)
+	return reply.Processes, err
+}
+
+// Private methods
+
+// Calls the method once, replacing the connection if it was lost
+func (self *Client) call(ctx context.Context, method string, query interface{}, reply interface{}) error {
+	conn, err := self.connection(ctx)
+	if err != nil {
+		return err
+	}
+	err = call(ctx, conn, method, query, reply)
+	if ctx.Err() == nil && isConnError(err) {
+		self.drop(conn)
+	}
+	return newError(method, err)
+}
+
+// Like call but retries once on a new connection
+func (self *Client) get(ctx context.Context, method string, query interface{}, reply interface{}) error {
+	err := self.call(ctx, method, query, reply)
+	if ctx.Err() == nil && isConnError(err) {
+		err = self.call(ctx, method, query, reply)
+	}
+	return err
+}
+
+func (self *Client) connection(ctx context.Context) (*rpc.Client, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if self.conn == nil {
+		conn, err := self.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		self.conn = conn
+	}
+	return self.conn, nil
+}
+
+func (self *Client) drop(conn *rpc.Client) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.conn == conn {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+func (self *Client) connect(ctx context.Context) (*rpc.Client, error) {
+	conn, err := netutil.DialURIContext(ctx, self.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.options.TLS != nil {
+		config, err := self.tlsConfig()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	client := rpc.NewClient(conn)
+
+	if self.options.Token != "" {
+		err = call(ctx, client, "crank.Authenticate", &api.AuthQuery{Token: self.options.Token}, &api.AuthReply{})
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("authentication failed: %s", err)
+		}
+	}
+	return client, nil
+}
+
+func (self *Client) tlsConfig() (*tls.Config, error) {
+	config := self.options.TLS
+	if config.ServerName != "" {
+		return config, nil
+	}
+
+	_, addr, err := netutil.ParseURI(self.uri)
+	if err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = strings.Trim(host, "[]")
+	}
+	return config, nil
+}
+
+// Returns early with the error of the context if it's done first
+func call(ctx context.Context, client *rpc.Client, method string, query interface{}, reply interface{}) error {
+	c := client.Go(method, query, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
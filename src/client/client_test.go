@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+	"github.com/pusher/crank/src/cranktest"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(cranktest.Main(m))
+}
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		message string
+		reason  error
+	}{
+		{"New process is already being started", ErrStartInProgress},
+		{"Passed pid (1) doesn't match the current pid (2)", ErrPidMismatch},
+		{"Passed pid (1) doesn't match any of the ready pids", ErrPidMismatch},
+		{"Manager is shutting down", ErrShuttingDown},
+		{"Manager has stopped", ErrShuttingDown},
+		{"Cancelled", nil},
+	}
+	for _, test := range tests {
+		err := newError("crank.Run", rpc.ServerError(test.message))
+		if err.Error() != test.message {
+			t.Errorf("Expected %q, got %q", test.message, err)
+		}
+		if reason := errors.Unwrap(err); reason != test.reason {
+			t.Errorf("Expected %q to be %v, got %v", test.message, test.reason, reason)
+		}
+	}
+
+	if err := newError("crank.Run", rpc.ErrShutdown); err != rpc.ErrShutdown {
+		t.Errorf("Expected the connection error as is, got %v", err)
+	}
+}
+
+func testClient(t *testing.T) (*cranktest.Harness, *Client, int) {
+	h := cranktest.New(t, &crank.ProcessConfig{
+		Command:      cranktest.Child(),
+		StartTimeout: crank.Duration(30 * time.Second),
+		StopTimeout:  crank.Duration(30 * time.Second),
+	})
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	c, err := Dial(context.Background(), h.Ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return h, c, pid
+}
+
+func TestClientRun(t *testing.T) {
+	_, c, pid := testClient(t)
+	ctx := context.Background()
+
+	err := c.Run(ctx, &StartQuery{Pid: pid + 1, Wait: true})
+	if !errors.Is(err, ErrPidMismatch) {
+		t.Errorf("Expected ErrPidMismatch, got %v", err)
+	}
+
+	never := cranktest.Child("-ready-after", "-1s")
+	if err = c.Run(ctx, &StartQuery{Command: never}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Run(ctx, &StartQuery{}); !errors.Is(err, ErrStartInProgress) {
+		t.Errorf("Expected ErrStartInProgress, got %v", err)
+	}
+	if err = c.Cancel(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := cranktest.Child("-ready-after", "-1s", "-exit-after", "0s", "-code", "3")
+	if err = c.Run(ctx, &StartQuery{Command: failing, Wait: true}); err != ExitError(3) {
+		t.Errorf("Expected ExitError(3), got %v", err)
+	}
+
+	ps, err := c.Ps(ctx, &PsQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Pid != pid {
+		t.Errorf("Expected pid=%d to be the only process, got %v", pid, ps)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	h, c, _ := testClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	never := cranktest.Child("-ready-after", "-1s")
+	if err := c.Run(ctx, &StartQuery{Command: never, Wait: true}); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The start carries on until it's cancelled
+	if err := c.Cancel(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_FAILED)
+}
+
+func TestClientReconnect(t *testing.T) {
+	_, c, pid := testClient(t)
+	ctx := context.Background()
+
+	// Only the calls that don't change anything are retried
+	c.conn.Close()
+	if err := c.Kill(ctx, &KillQuery{Signal: "SIGCONT"}); err != rpc.ErrShutdown {
+		t.Errorf("Expected rpc.ErrShutdown, got %v", err)
+	}
+	if err := c.Kill(ctx, &KillQuery{Signal: "SIGCONT"}); err != nil {
+		t.Errorf("Expected a new connection, got %v", err)
+	}
+
+	c.conn.Close()
+	ps, err := c.Ps(ctx, &PsQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Pid != pid {
+		t.Errorf("Expected pid=%d, got %v", pid, ps)
+	}
+
+	c.Close()
+	if _, err = c.Ps(ctx, &PsQuery{}); err != rpc.ErrShutdown {
+		t.Errorf("Expected rpc.ErrShutdown once closed, got %v", err)
+	}
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	_, c, _ := testClient(t)
+	ctx := context.Background()
+
+	if err := c.ConfigValidate(ctx, "", "", nil); err != nil {
+		t.Errorf("Expected the app's config to be valid, got %v", err)
+	}
+	if err := c.ConfigValidate(ctx, "", "app.yaml", []byte("command: [\"/bin/true\"]\n")); err != nil {
+		t.Errorf("Expected the YAML config to be valid, got %v", err)
+	}
+	if err := c.ConfigValidate(ctx, "", "app.yaml", []byte("commands: [\"/bin/true\"]\n")); err == nil {
+		t.Error("Expected the unknown field to be rejected")
+	}
+}
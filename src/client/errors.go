@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+
+	"github.com/pusher/crank/src/api"
+)
+
+// Reasons crank gives for refusing a call. Match them with errors.Is.
+var (
+	// Another start or rollback is running, see the restart_queue setting
+	ErrStartInProgress = errors.New("start already in progress")
+	// The pid of the query isn't one of the ready processes
+	ErrPidMismatch = errors.New("pid mismatch")
+	// The manager is shutting down or has stopped
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+// Error is returned when crank refuses a call. It matches one of the Err
+// variables with errors.Is when it's one of their reasons.
+type Error struct {
+	Method  string // eg "crank.Run"
+	Message string // As given by crank
+	reason  error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.reason
+}
+
+// ExitError is returned by Run and Rollback when the new process exited
+// before being ready. It's the exit code.
+type ExitError int
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exited with %d", e)
+}
+
+// Wraps the errors replied by crank. The others, like the connection
+// errors, are returned as is.
+func newError(method string, err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	message := string(serverErr)
+	e := &Error{Method: method, Message: message}
+	switch {
+	case message == api.ERR_START_IN_PROGRESS:
+		e.reason = ErrStartInProgress
+	case strings.HasPrefix(message, api.ERR_PID_MISMATCH):
+		e.reason = ErrPidMismatch
+	case message == api.ERR_SHUTTING_DOWN, message == api.ERR_STOPPED:
+		e.reason = ErrShuttingDown
+	}
+	return e
+}
+
+// Whether the connection needs to be replaced after the error
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(rpc.ServerError)
+	return !ok
+}
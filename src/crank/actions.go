@@ -2,19 +2,41 @@ package crank
 
 type Action interface{}
 
-type ShutdownAction bool
-
 // RPC actions
 
+type ShutdownAction struct {
+	query *ShutdownQuery
+	reply *ShutdownReply
+	done  chan<- error
+}
+
 type StartAction struct {
 	query *StartQuery
 	reply *StartReply
 	done  chan<- error
 }
 
-type InfoAction struct {
-	query *InfoQuery
-	reply *InfoReply
+type RollbackAction struct {
+	query *RollbackQuery
+	reply *StartReply
+	done  chan<- error
+}
+
+type ScaleAction struct {
+	query *ScaleQuery
+	reply *ScaleReply
+	done  chan<- error
+}
+
+type ConfigVersionsAction struct {
+	query *ConfigVersionsQuery
+	reply *ConfigVersionsReply
+	done  chan<- error
+}
+
+type HistoryAction struct {
+	query *HistoryQuery
+	reply *HistoryReply
 	done  chan<- error
 }
 
@@ -29,3 +51,41 @@ type KillAction struct {
 	reply *KillReply
 	done  chan<- error
 }
+
+type PauseAction struct {
+	query *PauseQuery
+	reply *PauseReply
+	done  chan<- error
+}
+
+type ResumeAction struct {
+	query *PauseQuery
+	reply *PauseReply
+	done  chan<- error
+}
+
+type ConfigGetAction struct {
+	query *ConfigGetQuery
+	reply *ConfigReply
+	done  chan<- error
+}
+
+type ConfigSetAction struct {
+	query *ConfigSetQuery
+	reply *ConfigReply
+	done  chan<- error
+}
+
+type ConfigValidateAction struct {
+	query *ConfigValidateQuery
+	reply *ConfigValidateReply
+	done  chan<- error
+}
+
+// Hands over the manager's state for an upgrade, then blocks the event loop
+// until resume is closed, which only happens if the upgrade failed
+type UpgradeAction struct {
+	reply  *appUpgradeState
+	done   chan<- error
+	resume <-chan struct{}
+}
@@ -0,0 +1,81 @@
+package crank
+
+import (
+	"github.com/pusher/crank/src/api"
+)
+
+// The queries, replies and errors of the API are in the api package, which
+// the clients use too
+const (
+	ERR_SHUTTING_DOWN     = api.ERR_SHUTTING_DOWN
+	ERR_STOPPED           = api.ERR_STOPPED
+	ERR_START_IN_PROGRESS = api.ERR_START_IN_PROGRESS
+	ERR_PID_MISMATCH      = api.ERR_PID_MISMATCH
+)
+
+const (
+	RESTART_STARTUP  = api.RESTART_STARTUP
+	RESTART_RUN      = api.RESTART_RUN
+	RESTART_ROLLBACK = api.RESTART_ROLLBACK
+	RESTART_SCHEDULE = api.RESTART_SCHEDULE
+	RESTART_MAX_AGE  = api.RESTART_MAX_AGE
+	RESTART_MAX_RSS  = api.RESTART_MAX_RSS
+
+	RESTART_IN_PROGRESS = api.RESTART_IN_PROGRESS
+	RESTART_COMPLETED   = api.RESTART_COMPLETED
+	RESTART_FAILED      = api.RESTART_FAILED
+)
+
+const (
+	SHUTDOWN_EXITED   = api.SHUTDOWN_EXITED
+	SHUTDOWN_KILLED   = api.SHUTDOWN_KILLED
+	SHUTDOWN_DETACHED = api.SHUTDOWN_DETACHED
+)
+
+type (
+	AuthQuery           = api.AuthQuery
+	AuthReply           = api.AuthReply
+	AppQuery            = api.AppQuery
+	ProcessQuery        = api.ProcessQuery
+	StartQuery          = api.StartQuery
+	StartReply          = api.StartReply
+	RollbackQuery       = api.RollbackQuery
+	ScaleQuery          = api.ScaleQuery
+	ScaleReply          = api.ScaleReply
+	ConfigVersionsQuery = api.ConfigVersionsQuery
+	ConfigVersionsReply = api.ConfigVersionsReply
+	ConfigVersion       = api.ConfigVersion
+	HistoryQuery        = api.HistoryQuery
+	HistoryReply        = api.HistoryReply
+	RestartRecord       = api.RestartRecord
+	InfoQuery           = api.InfoQuery
+	InfoReply           = api.InfoReply
+	Info                = api.Info
+	AppsQuery           = api.AppsQuery
+	AppsReply           = api.AppsReply
+	AppInfo             = api.AppInfo
+	PsQuery             = api.PsQuery
+	PsReply             = api.PsReply
+	ProcessInfo         = api.ProcessInfo
+	ByteCount           = api.ByteCount
+	KillQuery           = api.KillQuery
+	KillReply           = api.KillReply
+	PauseQuery          = api.PauseQuery
+	PauseReply          = api.PauseReply
+	ConfigGetQuery      = api.ConfigGetQuery
+	ConfigSetQuery      = api.ConfigSetQuery
+	ConfigReply         = api.ConfigReply
+	ConfigValidateQuery = api.ConfigValidateQuery
+	ConfigValidateReply = api.ConfigValidateReply
+	UpgradeQuery        = api.UpgradeQuery
+	UpgradeReply        = api.UpgradeReply
+	ShutdownQuery       = api.ShutdownQuery
+	ShutdownReply       = api.ShutdownReply
+	ShutdownProcessInfo = api.ShutdownProcessInfo
+
+	ProcessPolicy = api.ProcessPolicy
+	ProcessHooks  = api.ProcessHooks
+	Hook          = api.Hook
+	Duration      = api.Duration
+	ByteSize      = api.ByteSize
+)
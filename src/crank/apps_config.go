@@ -0,0 +1,50 @@
+package crank
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// Describes the apps run by a single crank daemon. Like the process config,
+// the format is chosen from the file extension. Eg in YAML:
+//
+//	apps:
+//	  api:
+//	    bind: tcp://:8080
+//	  worker:
+//	    bind: unix:///run/worker.sock
+//	    conf: /var/crank/worker.yaml
+type AppsConfig struct {
+	Apps map[string]*AppConfig `json:"apps" yaml:"apps" toml:"apps"`
+}
+
+type AppConfig struct {
+	Bind string `json:"bind" yaml:"bind" toml:"bind"`
+	// Defaults to $prefix/$name.conf
+	Conf string `json:"conf" yaml:"conf" toml:"conf"`
+}
+
+func LoadAppsConfig(path string) (config *AppsConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	config = new(AppsConfig)
+	if err = configFormatFor(path).decode(data, config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Apps) == 0 {
+		return nil, fmt.Errorf("No apps defined in %s", path)
+	}
+	for name, app := range config.Apps {
+		if name == "" {
+			return nil, fmt.Errorf("Apps need a name")
+		}
+		if app == nil || app.Bind == "" {
+			return nil, fmt.Errorf("Missing bind address for app %s", name)
+		}
+	}
+	return
+}
@@ -0,0 +1,245 @@
+package crank
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Permissions granted to the users of the control socket. Each RPC call
+// requires one of them.
+const (
+	PERM_ALL        = "*"
+	PERM_INFO       = "info" // info and apps
+	PERM_PS         = "ps"   // ps and history
+	PERM_RUN        = "run"
+	PERM_ROLLBACK   = "rollback"
+	PERM_SCALE      = "scale"
+	PERM_KILL       = "kill"
+	PERM_PAUSE      = "pause"      // pause and resume
+	PERM_CONFIG_GET = "config-get" // config get, validate and versions
+	PERM_CONFIG_SET = "config-set"
+	PERM_UPGRADE    = "upgrade"
+	PERM_SHUTDOWN   = "shutdown"
+)
+
+var knownPermissions = []string{
+	PERM_ALL,
+	PERM_INFO,
+	PERM_PS,
+	PERM_RUN,
+	PERM_ROLLBACK,
+	PERM_SCALE,
+	PERM_KILL,
+	PERM_PAUSE,
+	PERM_CONFIG_GET,
+	PERM_CONFIG_SET,
+	PERM_UPGRADE,
+	PERM_SHUTDOWN,
+}
+
+// Describes who can use the control socket and what for. Like the process
+// config, the format is chosen from the file extension. Eg in YAML:
+//
+//	users:
+//	  - name: admin
+//	    uids: [0]
+//	    permissions: ["*"]
+//	  - name: monitoring
+//	    gids: [998]
+//	    token: s3cr3t
+//	    permissions: [info, ps]
+//	tls:
+//	  cert: /etc/crank/ctl.crt
+//	  key: /etc/crank/ctl.key
+//	  client_ca: /etc/crank/ca.crt
+//
+// Peers on a unix socket are identified by their uid and gids. Other peers
+// either present a client certificate signed by client_ca, matched by its
+// common name, or call Authenticate with a token.
+type AuthConfig struct {
+	Users []*AuthUser `json:"users" yaml:"users" toml:"users"`
+	TLS   *AuthTLS    `json:"tls" yaml:"tls" toml:"tls"`
+
+	tlsConfig *tls.Config
+}
+
+type AuthUser struct {
+	Name        string   `json:"name" yaml:"name" toml:"name"`
+	Uids        []int    `json:"uids" yaml:"uids" toml:"uids"`
+	Gids        []int    `json:"gids" yaml:"gids" toml:"gids"`
+	Token       string   `json:"token" yaml:"token" toml:"token"`
+	CommonName  string   `json:"common_name" yaml:"common_name" toml:"common_name"`
+	Permissions []string `json:"permissions" yaml:"permissions" toml:"permissions"`
+}
+
+type AuthTLS struct {
+	Cert     string `json:"cert" yaml:"cert" toml:"cert"`
+	Key      string `json:"key" yaml:"key" toml:"key"`
+	ClientCA string `json:"client_ca" yaml:"client_ca" toml:"client_ca"`
+}
+
+// Identity of a unix socket peer
+type peerCredentials struct {
+	pid  int
+	uid  int
+	gids []int // Primary group first
+}
+
+func LoadAuthConfig(path string) (config *AuthConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	config = new(AuthConfig)
+	if err = configFormatFor(path).decode(data, config); err != nil {
+		return nil, err
+	}
+
+	for i, user := range config.Users {
+		if user == nil {
+			return nil, fmt.Errorf("Empty user at index %d", i)
+		}
+		if len(user.Uids) == 0 && len(user.Gids) == 0 && user.Token == "" && user.CommonName == "" {
+			return nil, fmt.Errorf("User %q needs one of uids, gids, token or common_name", user.Name)
+		}
+		for _, perm := range user.Permissions {
+			if !stringIn(perm, knownPermissions) {
+				return nil, fmt.Errorf("Unknown permission %q for user %q", perm, user.Name)
+			}
+		}
+	}
+
+	if config.TLS != nil {
+		if config.tlsConfig, err = config.TLS.load(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (self *AuthTLS) load() (*tls.Config, error) {
+	if self.Cert == "" || self.Key == "" {
+		return nil, fmt.Errorf("TLS needs both a cert and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(self.Cert, self.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if self.ClientCA != "" {
+		pem, err := ioutil.ReadFile(self.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", self.ClientCA)
+		}
+		// Token users don't need a certificate
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Returns the users matching the credentials of a unix socket peer
+func (self *AuthConfig) unixUsers(cred *peerCredentials) (users []*AuthUser) {
+	for _, user := range self.Users {
+		if intIn(cred.uid, user.Uids) {
+			users = append(users, user)
+			continue
+		}
+		for _, gid := range cred.gids {
+			if intIn(gid, user.Gids) {
+				users = append(users, user)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Returns the users matching the common name of a verified client certificate
+func (self *AuthConfig) certUsers(commonName string) (users []*AuthUser) {
+	for _, user := range self.Users {
+		if user.CommonName != "" && user.CommonName == commonName {
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+func (self *AuthConfig) tokenUser(token string) *AuthUser {
+	for _, user := range self.Users {
+		if user.Token != "" && subtle.ConstantTimeCompare([]byte(user.Token), []byte(token)) == 1 {
+			return user
+		}
+	}
+	return nil
+}
+
+// Permissions granted to a single control connection. net/rpc serves the
+// requests of a connection concurrently, so Authenticate can grant more
+// while other requests check them.
+type session struct {
+	mutex       sync.RWMutex
+	names       []string
+	permissions map[string]bool
+	cleartext   bool // A TCP connection without TLS, tokens would leak
+}
+
+func newSession() *session {
+	return &session{permissions: make(map[string]bool)}
+}
+
+func (self *session) grant(users ...*AuthUser) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, user := range users {
+		self.names = append(self.names, user.Name)
+		for _, perm := range user.Permissions {
+			self.permissions[perm] = true
+		}
+	}
+}
+
+func (self *session) allowed(perm string) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.permissions[PERM_ALL] || self.permissions[perm]
+}
+
+func (self *session) String() string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if len(self.names) == 0 {
+		return "anonymous"
+	}
+	return fmt.Sprint(self.names)
+}
+
+func intIn(i int, list []int) bool {
+	for _, j := range list {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
+
+func stringIn(s string, list []string) bool {
+	for _, t := range list {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package crank
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func writeAuthConfig(t *testing.T, dir, data string) string {
+	path := filepath.Join(dir, "auth.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAuthConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := []string{
+		"users:\n  - name: nobody\n    permissions: [ps]\n",
+		"users:\n  - name: ops\n    uids: [0]\n    permissions: [launch]\n",
+		"tls:\n  cert: /nonexistent.crt\n",
+	}
+	for _, data := range invalid {
+		if _, err = LoadAuthConfig(writeAuthConfig(t, dir, data)); err == nil {
+			t.Errorf("%q should be invalid", data)
+		}
+	}
+
+	config, err := LoadAuthConfig(writeAuthConfig(t, dir, `
+users:
+  - name: admin
+    uids: [0]
+    permissions: ["*"]
+  - name: monitoring
+    gids: [998]
+    token: s3cr3t
+    permissions: [info, ps]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := config.unixUsers(&peerCredentials{uid: 1000, gids: []int{1000, 998}})
+	if len(users) != 1 || users[0].Name != "monitoring" {
+		t.Error("unix users", users)
+	}
+	if user := config.tokenUser("s3cr3t"); user == nil || user.Name != "monitoring" {
+		t.Error("token user", user)
+	}
+	if user := config.tokenUser("s3cr3"); user != nil {
+		t.Error("token user", user)
+	}
+
+	sess := newSession()
+	sess.grant(users...)
+	if !sess.allowed(PERM_PS) || sess.allowed(PERM_RUN) {
+		t.Error("permissions", sess.permissions)
+	}
+	sess.grant(config.unixUsers(&peerCredentials{uid: 0, gids: []int{0}})...)
+	if !sess.allowed(PERM_RUN) {
+		t.Error("permissions", sess.permissions)
+	}
+}
+
+func TestRPCServerPermissions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only available on linux")
+	}
+
+	dir, err := ioutil.TempDir("", "crank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := LoadAuthConfig(writeAuthConfig(t, dir, `
+users:
+  - name: monitoring
+    uids: [`+strconv.Itoa(os.Getuid())+`]
+    permissions: [info]
+  - name: deploy
+    token: s3cr3t
+    permissions: [run]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "ctl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewRPCServer(NewSupervisor("test"), config).Accept(listener)
+
+	client, err := rpc.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err = client.Call("crank.Info", &InfoQuery{}, &InfoReply{}); err != nil {
+		t.Error("info", err)
+	}
+	err = client.Call("crank.Run", &StartQuery{}, &StartReply{})
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Error("run", err)
+	}
+
+	if err = client.Call("crank.Authenticate", &AuthQuery{Token: "nope"}, &AuthReply{}); err == nil {
+		t.Error("invalid token accepted")
+	}
+	var reply AuthReply
+	if err = client.Call("crank.Authenticate", &AuthQuery{Token: "s3cr3t"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Name != "deploy" {
+		t.Error("reply", reply)
+	}
+	// Allowed now, fails because there is no app
+	err = client.Call("crank.Run", &StartQuery{}, &StartReply{})
+	if err == nil || strings.Contains(err.Error(), "Permission denied") {
+		t.Error("run", err)
+	}
+
+	// Authenticate runs concurrently with the other calls of the connection
+	var calls []*rpc.Call
+	for i := 0; i < 10; i++ {
+		calls = append(calls,
+			client.Go("crank.Authenticate", &AuthQuery{Token: "s3cr3t"}, &AuthReply{}, nil),
+			client.Go("crank.Info", &InfoQuery{}, &InfoReply{}, nil))
+	}
+	for _, call := range calls {
+		if <-call.Done; call.Error != nil {
+			t.Error(call.ServiceMethod, call.Error)
+		}
+	}
+}
+
+func TestRPCServerCleartextToken(t *testing.T) {
+	config := &AuthConfig{Users: []*AuthUser{{Name: "deploy", Token: "s3cr3t", Permissions: []string{PERM_RUN}}}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go NewRPCServer(NewSupervisor("test"), config).Accept(listener)
+
+	client, err := rpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Call("crank.Authenticate", &AuthQuery{Token: "s3cr3t"}, &AuthReply{})
+	if err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Error("token accepted over cleartext TCP", err)
+	}
+}
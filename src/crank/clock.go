@@ -0,0 +1,48 @@
+package crank
+
+import (
+	"time"
+)
+
+// Clock is where the timeout trackers get the time from. The tests replace
+// it with a fake one to make the timeouts deterministic, see
+// Manager.SetClock.
+type Clock interface {
+	Now() time.Time
+	// Like time.NewTimer
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// Like time.Timer, except that Reset takes the time to fire at. A fake clock
+// can't then move between computing the duration and setting the timer.
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(deadline time.Time) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t realTimer) Reset(deadline time.Time) bool {
+	return t.timer.Reset(time.Until(deadline))
+}
@@ -0,0 +1,106 @@
+package crank
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Serialization of the config files
+type configFormat interface {
+	// Decodes data into v. Unknown fields are errors.
+	decode(data []byte, v interface{}) error
+	// Encodes config. If original isn't empty, the format should keep as much
+	// of its layout as possible (comments, ordering of keys).
+	encode(config *ProcessConfig, original []byte) ([]byte, error)
+}
+
+// Picks the format from the file extension, defaulting to JSON. Numbered
+// config versions (eg: app.yaml.3) use the format of the original file.
+func configFormatFor(path string) configFormat {
+	ext := filepath.Ext(path)
+	if _, err := strconv.Atoi(strings.TrimPrefix(ext, ".")); err == nil {
+		ext = filepath.Ext(strings.TrimSuffix(path, ext))
+	}
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		return yamlFormat{}
+	case ".toml":
+		return tomlFormat{}
+	default:
+		return jsonFormat{}
+	}
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) decode(data []byte, v interface{}) error {
+	jsonDecoder := json.NewDecoder(bytes.NewReader(data))
+	jsonDecoder.DisallowUnknownFields()
+	return jsonDecoder.Decode(v)
+}
+
+// JSON doesn't have comments so there is nothing to keep
+func (jsonFormat) encode(config *ProcessConfig, _ []byte) ([]byte, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Finds the value of a config field from its serialized name, using the
+// struct tags of the given format (eg: "yaml"). Slice elements are
+// addressed by index.
+func configField(v reflect.Value, tag string, path []string) (reflect.Value, bool) {
+	for _, name := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			found := false
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				if strings.Split(field.Tag.Get(tag), ",")[0] == name {
+					v = v.Field(i)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return v, false
+			}
+		case reflect.Slice:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= v.Len() {
+				return v, false
+			}
+			v = v.Index(i)
+		default:
+			return v, false
+		}
+	}
+	return v, true
+}
+
+// Compares a field between two configs. Unknown fields are never equal.
+func configFieldEqual(a, b *ProcessConfig, tag string, path []string) bool {
+	va, ok := configField(reflect.ValueOf(a), tag, path)
+	if !ok {
+		return false
+	}
+	vb, ok := configField(reflect.ValueOf(b), tag, path)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(va.Interface(), vb.Interface())
+}
@@ -0,0 +1,255 @@
+package crank
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFormatFor(t *testing.T) {
+	for path, expected := range map[string]configFormat{
+		"app.conf":      jsonFormat{},
+		"app.yaml":      yamlFormat{},
+		"app.yml.3":     yamlFormat{},
+		"/a.b/app.TOML": tomlFormat{},
+	} {
+		if format := configFormatFor(path); format != expected {
+			t.Errorf("%s: %T", path, format)
+		}
+	}
+}
+
+func TestYAMLConfigRoundTrip(t *testing.T) {
+	original := `# Managed by ops
+cwd: /srv/app # release dir
+# How to start
+command:
+  - ./server
+  - -v
+start_timeout: 1m
+`
+	c, err := decodeProcessConfig(yamlFormat{}, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StartTimeout != Duration(time.Minute) || c.StopTimeout != DefaultConfig.StopTimeout || len(c.Command) != 2 {
+		t.Error(c)
+	}
+
+	c.Cwd = "/srv/app2"
+	data, err := yamlFormat{}.encode(c, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Managed by ops
+cwd: /srv/app2 # release dir
+# How to start
+command:
+  - ./server
+  - -v
+start_timeout: 1m
+stop_timeout: 30s
+`
+	if string(data) != expected {
+		t.Errorf("got:\n%s", data)
+	}
+
+	if _, err = decodeProcessConfig(yamlFormat{}, []byte("cmd: [ls]")); err == nil {
+		t.Error("unknown fields should be rejected")
+	}
+}
+
+func TestTOMLConfigRoundTrip(t *testing.T) {
+	original := `# Managed by ops
+cwd = "/srv/app" # release dir
+
+# How to start
+command = [
+  "./server", # the binary
+  "-v",
+]
+start_timeout = 60
+`
+	c, err := decodeProcessConfig(tomlFormat{}, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StartTimeout != Duration(time.Minute) || c.StopTimeout != DefaultConfig.StopTimeout || len(c.Command) != 2 {
+		t.Error(c)
+	}
+
+	c.Cwd = "/srv/app2"
+	data, err := tomlFormat{}.encode(c, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Managed by ops
+cwd = "/srv/app2" # release dir
+
+# How to start
+command = [
+  "./server", # the binary
+  "-v",
+]
+start_timeout = 60
+stop_timeout = "30s"
+`
+	if string(data) != expected {
+		t.Errorf("got:\n%s", data)
+	}
+
+	if _, err = decodeProcessConfig(tomlFormat{}, []byte("cmd = 1")); err == nil {
+		t.Error("unknown fields should be rejected")
+	}
+}
+
+func TestTOMLConfigSet(t *testing.T) {
+	original := `# Managed by ops
+command = ["./server"] # the binary
+cwd = "/srv/app"
+
+replicas = 2 # one per core
+
+[hooks]
+  # Warms the cache
+  [hooks.pre_start]
+  command = [
+    "./warm", # it's idempotent
+    "--all",
+  ]
+  timeout = "1m"
+
+  [hooks.post_exit]
+  command = ["./report"]
+
+# Only releases
+[policy]
+cwd = "/srv/app/releases/*"
+`
+	dir, err := ioutil.TempDir("", "crank-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.toml")
+	if err = ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadProcessConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = c.set(map[string]string{
+		"replicas":     "3",
+		"stop_timeout": "10s",
+		"hooks":        `{"pre_start": {"command": ["./warm"], "timeout": "1m"}, "post_ready": {"command": ["./check"]}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Managed by ops
+command = ["./server"] # the binary
+cwd = "/srv/app"
+
+replicas = 3 # one per core
+start_timeout = "30s"
+stop_timeout = "10s"
+
+[hooks]
+  # Warms the cache
+  [hooks.pre_start]
+  command = ["./warm"]
+  timeout = "1m"
+
+# Only releases
+[policy]
+cwd = "/srv/app/releases/*"
+
+[hooks.post_ready]
+command = ["./check"]
+`
+	if string(data) != expected {
+		t.Errorf("got:\n%s", data)
+	}
+
+	saved, err := loadProcessConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, c) {
+		t.Errorf("saved %v, expected %v", saved, c)
+	}
+}
+
+func TestTOMLConfigFallback(t *testing.T) {
+	// Dotted keys can't be extended by the tables of the encoder
+	original := "# Managed by ops\nhooks.pre_start.command = [\"./warm\"]\n"
+	c, err := decodeProcessConfig(tomlFormat{}, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Hooks.PreStart.Timeout = Duration(time.Minute)
+	data, err := tomlFormat{}.encode(c, []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeProcessConfig(tomlFormat{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, c) {
+		t.Errorf("got:\n%s", data)
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	doc := `a = "x#y" # comment
+"b.c" = '''
+multi ] line
+'''
+d = """a\"""" # ends with a quote
+e = [ # open
+  { f = "}" }, # inline table
+]
+[ "t.u" . v ] # header
+w.x = 1
+`
+	parsed, err := parseTOML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path  []string
+		value string
+	}{
+		{[]string{"a"}, `"x#y"`},
+		{[]string{"b.c"}, "'''\nmulti ] line\n'''"},
+		{[]string{"d"}, `"""a\""""`},
+		{[]string{"e"}, "[ # open\n  { f = \"}\" }, # inline table\n]"},
+		{[]string{"t.u", "v"}, ""},
+		{[]string{"t.u", "v", "w", "x"}, "1"},
+	}
+	if len(parsed.statements) != len(expected) {
+		t.Fatalf("got %d statements", len(parsed.statements))
+	}
+	for i, st := range parsed.statements {
+		if !reflect.DeepEqual(st.path, expected[i].path) || st.value() != expected[i].value {
+			t.Errorf("%d: got %q = %q", i, st.path, st.value())
+		}
+	}
+
+	if _, err = parseTOML("a = [1,\n"); err == nil {
+		t.Error("unterminated arrays should be rejected")
+	}
+}
@@ -0,0 +1,400 @@
+package crank
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+type tomlFormat struct{}
+
+func (tomlFormat) decode(data []byte, v interface{}) error {
+	md, err := toml.Decode(string(data), v)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("Unknown config fields: %v", undecoded)
+	}
+	return nil
+}
+
+// The library doesn't keep comments, so the config is encoded by it and the
+// changed values are then patched into the original document, like
+// mergeYAMLMapping does. If the patched document doesn't decode to the same
+// config, for example because the original used dotted keys where the
+// encoder uses tables, the encoded config is used as is.
+func (tomlFormat) encode(config *ProcessConfig, original []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+
+	previous := new(ProcessConfig)
+	if _, err := toml.Decode(string(original), previous); err != nil || len(bytes.TrimSpace(original)) == 0 {
+		// Nothing worth keeping
+		return encoded, nil
+	}
+	doc, err := parseTOML(string(original))
+	if err != nil {
+		return encoded, nil
+	}
+	updated, err := parseTOML(string(encoded))
+	if err != nil {
+		return encoded, nil
+	}
+
+	merged := mergeTOML(doc, updated, func(path []string) bool {
+		return configFieldEqual(previous, config, "toml", path)
+	})
+
+	expected, actual := new(ProcessConfig), new(ProcessConfig)
+	if _, err := toml.Decode(string(encoded), expected); err != nil {
+		return nil, err
+	}
+	if _, err := toml.Decode(string(merged), actual); err != nil || !reflect.DeepEqual(expected, actual) {
+		return encoded, nil
+	}
+	return merged, nil
+}
+
+// A TOML document split into statements. Comments and blank lines belong to
+// the statement that follows them, or to the trailer at the end.
+type tomlDocument struct {
+	statements []*tomlStatement
+	trailer    string
+}
+
+// A table header or a key/value pair
+type tomlStatement struct {
+	text                 string // including the leading comments and the final newline
+	header               bool
+	table                []string // the table the statement is in, or defines
+	key                  string   // as written, relative to table
+	path                 []string // full path of the value, or of the table of a header
+	valueStart, valueEnd int      // offsets of the value in text
+}
+
+func (self *tomlStatement) value() string {
+	return self.text[self.valueStart:self.valueEnd]
+}
+
+func parseTOML(doc string) (*tomlDocument, error) {
+	result := new(tomlDocument)
+	var table []string
+	start := 0 // of the current statement, leading comments included
+	i := 0
+	for i < len(doc) {
+		lineStart := i
+		i = skipTOMLSpace(doc, i)
+		if i == len(doc) || doc[i] == '\n' || doc[i] == '#' {
+			// Comment or blank line
+			i = skipTOMLLine(doc, i)
+			continue
+		}
+
+		st := new(tomlStatement)
+		if doc[i] == '[' {
+			if strings.HasPrefix(doc[i:], "[[") {
+				return nil, fmt.Errorf("Arrays of tables are not supported")
+			}
+			end, err := scanTOMLKey(doc, i+1, ']')
+			if err != nil {
+				return nil, err
+			}
+			if table, err = splitTOMLKey(doc[i+1 : end]); err != nil {
+				return nil, err
+			}
+			st.header = true
+			st.path = table
+			i = end + 1
+		} else {
+			eq, err := scanTOMLKey(doc, i, '=')
+			if err != nil {
+				return nil, err
+			}
+			st.key = strings.TrimSpace(doc[i:eq])
+			keyPath, err := splitTOMLKey(st.key)
+			if err != nil {
+				return nil, err
+			}
+			st.path = append(table[:len(table):len(table)], keyPath...)
+
+			valueStart := skipTOMLSpace(doc, eq+1)
+			valueEnd, err := scanTOMLValue(doc, valueStart)
+			if err != nil {
+				return nil, err
+			}
+			st.valueStart = valueStart - start
+			st.valueEnd = valueEnd - start
+			i = valueEnd
+		}
+		st.table = table
+
+		// The rest of the line can only hold a comment
+		i = skipTOMLSpace(doc, i)
+		if i < len(doc) && doc[i] != '\n' && doc[i] != '#' {
+			return nil, fmt.Errorf("Unexpected %q after %q", doc[i], doc[lineStart:i])
+		}
+		i = skipTOMLLine(doc, i)
+		st.text = doc[start:i]
+		if !strings.HasSuffix(st.text, "\n") {
+			st.text += "\n"
+		}
+		result.statements = append(result.statements, st)
+		start = i
+	}
+	result.trailer = doc[start:]
+	return result, nil
+}
+
+func skipTOMLSpace(doc string, i int) int {
+	for i < len(doc) && (doc[i] == ' ' || doc[i] == '\t' || doc[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// Returns the offset after the next newline
+func skipTOMLLine(doc string, i int) int {
+	if j := strings.IndexByte(doc[i:], '\n'); j >= 0 {
+		return i + j + 1
+	}
+	return len(doc)
+}
+
+// Returns the offset of the delimiter ending a key, skipping quoted parts
+func scanTOMLKey(doc string, i int, delim byte) (int, error) {
+	for ; i < len(doc) && doc[i] != '\n'; i++ {
+		switch doc[i] {
+		case delim:
+			return i, nil
+		case '"', '\'':
+			end, err := scanTOMLString(doc, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end - 1
+		}
+	}
+	return 0, fmt.Errorf("Expected %q in %q", delim, doc[:i])
+}
+
+// Returns the offset after the string starting at i, which can be any of
+// the four kinds of TOML strings
+func scanTOMLString(doc string, i int) (int, error) {
+	quote := doc[i : i+1]
+	if strings.HasPrefix(doc[i:], strings.Repeat(quote, 3)) {
+		quote = doc[i : i+3]
+	}
+	for j := i + len(quote); j < len(doc); j++ {
+		switch {
+		case doc[j] == '\\' && quote[0] == '"':
+			j++
+		case doc[j] == '\n' && len(quote) == 1:
+			return 0, fmt.Errorf("Unterminated string %s", doc[i:j])
+		case strings.HasPrefix(doc[j:], quote):
+			end := j + len(quote)
+			// Up to two quotes can end a multi-line string
+			for n := 0; len(quote) == 3 && n < 2 && end < len(doc) && doc[end] == quote[0]; n++ {
+				end++
+			}
+			return end, nil
+		}
+	}
+	return 0, fmt.Errorf("Unterminated string %s", doc[i:])
+}
+
+// Returns the offset after the value starting at i. Arrays and inline
+// tables can span multiple lines and contain comments.
+func scanTOMLValue(doc string, i int) (int, error) {
+	depth, end := 0, i
+	for i < len(doc) {
+		switch doc[i] {
+		case '"', '\'':
+			next, err := scanTOMLString(doc, i)
+			if err != nil {
+				return 0, err
+			}
+			i, end = next, next
+			continue
+		case '#':
+			// Up to the newline
+			if j := strings.IndexByte(doc[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(doc)
+			}
+			continue
+		case '\n':
+			if depth == 0 {
+				return end, nil
+			}
+		case ' ', '\t', '\r':
+		case '[', '{':
+			depth++
+			end = i + 1
+		case ']', '}':
+			depth--
+			end = i + 1
+		default:
+			end = i + 1
+		}
+		i++
+	}
+	if depth != 0 {
+		return 0, fmt.Errorf("Unterminated value %s", doc[end:])
+	}
+	return end, nil
+}
+
+// Splits a dotted key into its parts, unquoting them
+func splitTOMLKey(key string) (parts []string, err error) {
+	for i := 0; ; {
+		i = skipTOMLSpace(key, i)
+		end := i
+		var part string
+		if i < len(key) && (key[i] == '"' || key[i] == '\'') {
+			if end, err = scanTOMLString(key, i); err != nil {
+				return nil, err
+			}
+			part = key[i+1 : end-1]
+			if key[i] == '"' {
+				if part, err = strconv.Unquote(key[i:end]); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			for end < len(key) && key[end] != '.' && key[end] != ' ' && key[end] != '\t' {
+				end++
+			}
+			part = key[i:end]
+			if part == "" {
+				return nil, fmt.Errorf("Invalid key %q", key)
+			}
+		}
+		parts = append(parts, part)
+
+		i = skipTOMLSpace(key, end)
+		if i == len(key) {
+			return parts, nil
+		}
+		if key[i] != '.' {
+			return nil, fmt.Errorf("Invalid key %q", key)
+		}
+		i++
+	}
+}
+
+func tomlPathEqual(a, b []string) bool {
+	return len(a) == len(b) && strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+// Combines the layout of the original document with the values of the
+// updated one. Unchanged values are kept as they are, changed ones are
+// replaced in place, values that disappeared are removed with their
+// comments. New values are added at the end of their table, new tables at
+// the end of the document.
+func mergeTOML(original, updated *tomlDocument, unchanged func(path []string) bool) []byte {
+	findValue := func(doc *tomlDocument, path []string) *tomlStatement {
+		for _, st := range doc.statements {
+			if !st.header && tomlPathEqual(st.path, path) {
+				return st
+			}
+		}
+		return nil
+	}
+	findHeader := func(doc *tomlDocument, table []string) bool {
+		for _, st := range doc.statements {
+			if st.header && tomlPathEqual(st.path, table) {
+				return true
+			}
+		}
+		return false
+	}
+	hasTable := func(table []string) bool {
+		return len(table) == 0 || findHeader(original, table)
+	}
+
+	// Values of the updated document to add to each table, by table path
+	added := make(map[string][]*tomlStatement)
+	var newTables [][]string
+	for _, st := range updated.statements {
+		if st.header {
+			if !hasTable(st.path) {
+				newTables = append(newTables, st.path)
+			}
+			continue
+		}
+		if findValue(original, st.path) != nil {
+			continue
+		}
+		id := strings.Join(st.table, "\x00")
+		added[id] = append(added[id], st)
+	}
+	addValues := func(buf *bytes.Buffer, table []string) {
+		id := strings.Join(table, "\x00")
+		for _, st := range added[id] {
+			fmt.Fprintf(buf, "%s = %s\n", st.key, st.value())
+		}
+		delete(added, id)
+	}
+
+	var buf bytes.Buffer
+	var table []string
+	for _, st := range original.statements {
+		if st.header {
+			addValues(&buf, table)
+			table = st.path
+			if findHeader(updated, st.path) {
+				buf.WriteString(st.text)
+			}
+			continue
+		}
+
+		newValue := findValue(updated, st.path)
+		switch {
+		case newValue == nil:
+			// Removed
+		case unchanged(st.path):
+			buf.WriteString(st.text)
+		default:
+			buf.WriteString(st.text[:st.valueStart])
+			buf.WriteString(newValue.value())
+			buf.WriteString(st.text[st.valueEnd:])
+		}
+	}
+	addValues(&buf, table)
+	buf.WriteString(original.trailer)
+
+	for _, path := range newTables {
+		if len(added[strings.Join(path, "\x00")]) == 0 {
+			// Eg a parent table, or one set with dotted keys
+			continue
+		}
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", tomlKey(path))
+		addValues(&buf, path)
+	}
+	return buf.Bytes()
+}
+
+func tomlKey(path []string) string {
+	parts := make([]string, len(path))
+	for i, part := range path {
+		parts[i] = part
+		if part == "" || strings.IndexFunc(part, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) >= 0 {
+			parts[i] = strconv.Quote(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
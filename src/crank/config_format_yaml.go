@@ -0,0 +1,99 @@
+package crank
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+type yamlFormat struct{}
+
+func (yamlFormat) decode(data []byte, v interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	return decoder.Decode(v)
+}
+
+func (yamlFormat) encode(config *ProcessConfig, original []byte) ([]byte, error) {
+	var updated yaml.Node
+	if err := updated.Encode(config); err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	previous := new(ProcessConfig)
+	if yaml.Unmarshal(original, &doc) != nil || yaml.Unmarshal(original, previous) != nil || len(doc.Content) == 0 {
+		// Nothing worth keeping
+		return marshalYAML(&updated)
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("Expected a mapping at the root of the YAML document")
+	}
+	mergeYAMLMapping(root, &updated, func(path []string) bool {
+		return configFieldEqual(previous, config, "yaml", path)
+	})
+
+	return marshalYAML(&doc)
+}
+
+func marshalYAML(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Updates the dst mapping in place to contain the values of src. Keys are
+// kept in their original position with their comments, new keys are
+// appended and missing keys are removed. Values that didn't change, as
+// reported by unchanged, are left untouched to preserve their style.
+func mergeYAMLMapping(dst, src *yaml.Node, unchanged func(path []string) bool, path ...string) {
+	content := make([]*yaml.Node, 0, len(src.Content))
+
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key, value := dst.Content[i], dst.Content[i+1]
+		newValue := yamlMappingValue(src, key.Value)
+		if newValue == nil {
+			continue
+		}
+		keyPath := append(path[:len(path):len(path)], key.Value)
+
+		switch {
+		case unchanged(keyPath):
+		case value.Kind == yaml.MappingNode && newValue.Kind == yaml.MappingNode:
+			mergeYAMLMapping(value, newValue, unchanged, keyPath...)
+		default:
+			newValue.HeadComment = value.HeadComment
+			newValue.LineComment = value.LineComment
+			newValue.FootComment = value.FootComment
+			value = newValue
+		}
+		content = append(content, key, value)
+	}
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		if yamlMappingValue(dst, src.Content[i].Value) == nil {
+			content = append(content, src.Content[i], src.Content[i+1])
+		}
+	}
+
+	dst.Content = content
+}
+
+func yamlMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
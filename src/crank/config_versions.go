@@ -0,0 +1,82 @@
+package crank
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pusher/crank/src/api"
+)
+
+const DEFAULT_CONFIG_HISTORY = 5
+
+func configVersionPath(path string, version int) string {
+	return fmt.Sprintf("%s.%d", path, version)
+}
+
+// Returns the existing version numbers, oldest first
+func listConfigVersions(path string) (versions []int, err error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		version, err := strconv.Atoi(strings.TrimPrefix(match, path+"."))
+		if err != nil || version <= 0 {
+			continue // tmp files and others
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return
+}
+
+func loadConfigVersion(path string, version int) (*ConfigVersion, error) {
+	versionPath := configVersionPath(path, version)
+	fi, err := os.Stat(versionPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown config version %d", version)
+	}
+	config, err := loadProcessConfig(versionPath)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigVersion{Version: version, Time: fi.ModTime(), Config: (*api.ProcessConfig)(config)}, nil
+}
+
+// Copies the config file as the new latest version and removes the
+// versions exceeding keep.
+func saveConfigVersion(path string, keep int) (version int, err error) {
+	if keep <= 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	versions, err := listConfigVersions(path)
+	if err != nil {
+		return
+	}
+
+	version = 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1] + 1
+	}
+	if err = writeFileAtomic(configVersionPath(path, version), data, 0644); err != nil {
+		return
+	}
+
+	versions = append(versions, version)
+	for len(versions) > keep {
+		os.Remove(configVersionPath(path, versions[0]))
+		versions = versions[1:]
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package crank
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.conf")
+
+	for i, cwd := range []string{"a", "b", "c", "d"} {
+		if err = (&ProcessConfig{Cwd: cwd}).save(path); err != nil {
+			t.Fatal(err)
+		}
+		version, err := saveConfigVersion(path, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != i+1 {
+			t.Error("version", version)
+		}
+	}
+
+	versions, err := listConfigVersions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0] != 2 || versions[2] != 4 {
+		t.Error("versions", versions)
+	}
+
+	v, err := loadConfigVersion(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Config.Cwd != "c" {
+		t.Error("config", v.Config)
+	}
+
+	if _, err = loadConfigVersion(path, 1); err == nil {
+		t.Error("version 1 should have been pruned")
+	}
+}
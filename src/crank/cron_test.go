@@ -0,0 +1,52 @@
+package crank
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		spec, from, next string
+	}{
+		{"30 3 * * *", "2024-05-01 12:00", "2024-05-02 03:30"},
+		{"30 3 * * *", "2024-05-01 03:29", "2024-05-01 03:30"},
+		{"30 3 * * *", "2024-05-01 03:30", "2024-05-02 03:30"},
+		{"*/15 * * * *", "2024-05-01 12:07", "2024-05-01 12:15"},
+		{"0 0 * * 0", "2024-05-01 12:00", "2024-05-05 00:00"}, // Sunday
+		{"0 0 * * 7", "2024-05-01 12:00", "2024-05-05 00:00"},
+		{"0 9 * * 1-5", "2024-05-03 10:00", "2024-05-06 09:00"},  // Friday to Monday
+		{"0 0 1,15 * 1", "2024-05-02 00:00", "2024-05-06 00:00"}, // the 15th or a Monday
+		{"0 3 */2 * 1", "2024-05-01 12:00", "2024-05-13 03:00"},  // an odd day and a Monday
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"@daily", "2024-12-31 23:59", "2025-01-01 00:00"},
+	}
+	for _, test := range tests {
+		s, err := parseCronSchedule(test.spec)
+		if err != nil {
+			t.Error(test.spec, err)
+			continue
+		}
+		if next := s.next(at(test.from)); !next.Equal(at(test.next)) {
+			t.Errorf("%s from %s: got %s, expected %s", test.spec, test.from, next, test.next)
+		}
+	}
+
+	if s, _ := parseCronSchedule("0 0 30 2 *"); !s.next(at("2024-01-01 00:00")).IsZero() {
+		t.Error("February 30th should never happen")
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Error("should be rejected", spec)
+		}
+	}
+}
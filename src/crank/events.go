@@ -1,5 +1,9 @@
 package crank
 
+import (
+	"time"
+)
+
 type Event interface{}
 
 type ProcessReadyEvent struct {
@@ -11,3 +15,24 @@ type ProcessExitEvent struct {
 	code    int
 	err     error
 }
+
+// SIGSTOP or similar
+type ProcessPausedEvent struct {
+	process *Process
+}
+
+// SIGCONT
+type ProcessResumedEvent struct {
+	process *Process
+}
+
+// EXTEND_TIMEOUT_USEC
+type ProcessExtendTimeoutEvent struct {
+	process   *Process
+	extension time.Duration
+}
+
+type ProcessStatusEvent struct {
+	process *Process
+	status  string
+}
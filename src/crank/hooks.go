@@ -0,0 +1,146 @@
+package crank
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Names of the hooks, also used in their log prefix
+const (
+	HOOK_PRE_START  = "pre_start"
+	HOOK_POST_READY = "post_ready"
+	HOOK_PRE_STOP   = "pre_stop"
+	HOOK_POST_EXIT  = "post_exit"
+)
+
+const DEFAULT_HOOK_TIMEOUT = 30 * time.Second
+
+// Sent to the manager once a hook has finished
+type HookEvent struct {
+	name       string
+	process    *Process // nil for pre_start
+	generation int
+	err        error
+}
+
+// Returns the hook of the given name, or nil if it's not configured
+func getHook(hooks *ProcessHooks, name string) *Hook {
+	if hooks == nil {
+		return nil
+	}
+	switch name {
+	case HOOK_PRE_START:
+		return hooks.PreStart
+	case HOOK_POST_READY:
+		return hooks.PostReady
+	case HOOK_PRE_STOP:
+		return hooks.PreStop
+	case HOOK_POST_EXIT:
+		return hooks.PostExit
+	}
+	return nil
+}
+
+func validateHooks(hooks *ProcessHooks) error {
+	for _, name := range []string{HOOK_PRE_START, HOOK_POST_READY, HOOK_PRE_STOP, HOOK_POST_EXIT} {
+		hook := getHook(hooks, name)
+		if hook == nil {
+			continue
+		}
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("Invalid %s hook: command is missing", name)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("Invalid %s hook: invalid timeout %v", name, hook.Timeout)
+		}
+	}
+	return nil
+}
+
+func hookTimeout(hook *Hook) time.Duration {
+	if hook.Timeout <= 0 {
+		return DEFAULT_HOOK_TIMEOUT
+	}
+	return time.Duration(hook.Timeout)
+}
+
+// Starts the hook of the config in the background if it's configured. A
+// HookEvent is sent once it has finished. Returns false if there is no such
+// hook.
+//
+// The hook runs in the cwd of the config with CRANK_HOOK set to its name and,
+// when it's about a process, CRANK_PID, CRANK_CID and CRANK_GENERATION.
+// post_exit also gets CRANK_EXIT_CODE.
+func (self *Manager) runHook(name string, config *ProcessConfig, p *Process, generation int, extraEnv ...string) bool {
+	hook := getHook(config.Hooks, name)
+	if hook == nil {
+		return false
+	}
+
+	env := append(os.Environ(), "CRANK_HOOK="+name)
+	if self.name != "" {
+		env = append(env, "CRANK_NAME="+self.name)
+	}
+	prefix := func() string {
+		if self.name != "" {
+			return fmt.Sprintf("%s [%s] %s ", time.Now().Format(time.StampMilli), self.name, name)
+		}
+		return fmt.Sprintf("%s %s ", time.Now().Format(time.StampMilli), name)
+	}
+	if p != nil {
+		env = append(env,
+			"CRANK_PID="+strconv.Itoa(p.Pid()),
+			"CRANK_CID="+strconv.Itoa(p.id),
+			"CRANK_GENERATION="+strconv.Itoa(p.generation),
+		)
+		prefix = func() string {
+			if self.name != "" {
+				return fmt.Sprintf("%s [%s] %s %s ", time.Now().Format(time.StampMilli), self.name, p, name)
+			}
+			return fmt.Sprintf("%s %s %s ", time.Now().Format(time.StampMilli), p, name)
+		}
+	}
+	env = append(env, extraEnv...)
+
+	self.log("Running the %s hook: %v", name, hook.Command)
+	self.hooksRunning += 1
+
+	go func() {
+		err := runHookCommand(hook, config.Cwd, env, prefix)
+		self.events <- &HookEvent{name, p, generation, err}
+	}()
+	return true
+}
+
+func runHookCommand(hook *Hook, cwd string, env []string, prefix func() string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout(hook))
+	defer cancel()
+
+	// The logger closes its end once the hook and its children are gone
+	_, logFile, err := startProcessLogger(os.Stdout, prefix)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = env
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	err = cmd.Start()
+	logFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out after %v", hookTimeout(hook))
+	}
+	return err
+}
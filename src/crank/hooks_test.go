@@ -0,0 +1,56 @@
+package crank
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProcessHooksDecoding(t *testing.T) {
+	c, err := decodeProcessConfig(jsonFormat{}, []byte(`{"command": ["ls"], "hooks": {"pre_start": {"command": ["true"], "timeout": "5m"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := getHook(c.Hooks, HOOK_PRE_START)
+	if hook == nil || hook.Command[0] != "true" || hookTimeout(hook) != 5*time.Minute {
+		t.Error("pre_start", hook)
+	}
+	if getHook(c.Hooks, HOOK_POST_EXIT) != nil {
+		t.Error("post_exit should be missing")
+	}
+	if err = validateHooks(c.Hooks); err != nil {
+		t.Error(err)
+	}
+
+	var none *ProcessHooks
+	if getHook(none, HOOK_PRE_STOP) != nil || validateHooks(none) != nil {
+		t.Error("missing hooks")
+	}
+
+	c, err = decodeProcessConfig(jsonFormat{}, []byte(`{"command": ["ls"], "hooks": {"pre_stop": {"timeout": 1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = validateHooks(c.Hooks); err == nil {
+		t.Error("hooks need a command")
+	}
+}
+
+func TestRunHookCommand(t *testing.T) {
+	prefix := func() string { return "" }
+
+	if err := runHookCommand(&Hook{Command: []string{"true"}}, "", nil, prefix); err != nil {
+		t.Error(err)
+	}
+	if err := runHookCommand(&Hook{Command: []string{"false"}}, "", nil, prefix); err == nil {
+		t.Error("failures should be reported")
+	}
+
+	hook := &Hook{Command: []string{"sleep", "10"}, Timeout: Duration(50 * time.Millisecond)}
+	start := time.Now()
+	if err := runHookCommand(hook, "", nil, prefix); err == nil {
+		t.Error("timeouts should be reported")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("hook not killed on timeout")
+	}
+}
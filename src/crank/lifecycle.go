@@ -0,0 +1,70 @@
+package crank
+
+import (
+	"fmt"
+	"time"
+)
+
+// Types of lifecycle events
+const (
+	LIFECYCLE_PROCESS_STARTED   = "process_started"
+	LIFECYCLE_PROCESS_READY     = "process_ready"
+	LIFECYCLE_PROCESS_STANDBY   = "process_standby" // A standby is ready to be promoted
+	LIFECYCLE_PROCESS_EXITED    = "process_exited"
+	LIFECYCLE_PROCESS_FAILED    = "process_failed" // Exited on its own with a non-zero code or a signal
+	LIFECYCLE_PROCESS_KILLED    = "process_killed" // Did not start or stop in time
+	LIFECYCLE_PROCESS_PAUSED    = "process_paused"
+	LIFECYCLE_PROCESS_RESUMED   = "process_resumed"
+	LIFECYCLE_ROLLOUT_COMPLETED = "rollout_completed"
+	LIFECYCLE_ROLLOUT_FAILED    = "rollout_failed"
+	LIFECYCLE_RESTART_SCHEDULED = "restart_scheduled" // An automatic restart is starting
+	LIFECYCLE_SHUTDOWN          = "shutdown"
+	LIFECYCLE_SHUTDOWN_KILL     = "shutdown_kill" // Shutdown requested twice
+	LIFECYCLE_SHUTDOWN_EXIT     = "shutdown_exit" // Shutdown requested three times
+)
+
+// LifecycleEvent reports a notable change in a manager to its observers,
+// unlike Event which is internal to the manager.
+type LifecycleEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	App        string    `json:"app,omitempty"`
+	Pid        int       `json:"pid,omitempty"`
+	Cid        int       `json:"cid,omitempty"`
+	Generation int       `json:"generation,omitempty"`
+	Code       int       `json:"code,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+func (e *LifecycleEvent) String() string {
+	return fmt.Sprintf("type=%s app=%s pid=%d cid=%d gen=%d code=%d message=%q",
+		e.Type, e.App, e.Pid, e.Cid, e.Generation, e.Code, e.Message)
+}
+
+// Observers are called from the manager's event loop and must not block.
+type LifecycleObserver func(*LifecycleEvent)
+
+// Registers an observer. Must be called before Run.
+func (self *Manager) Observe(observer LifecycleObserver) {
+	self.observers = append(self.observers, observer)
+}
+
+func (self *Manager) emit(event *LifecycleEvent) {
+	event.Time = time.Now()
+	event.App = self.name
+	for _, observer := range self.observers {
+		observer(event)
+	}
+}
+
+// Describes a process in an event of the given type
+func (self *Manager) emitProcess(eventType string, p *Process, code int, message string) {
+	self.emit(&LifecycleEvent{
+		Type:       eventType,
+		Pid:        p.Pid(),
+		Cid:        p.id,
+		Generation: p.generation,
+		Code:       code,
+		Message:    message,
+	})
+}
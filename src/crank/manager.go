@@ -1,18 +1,22 @@
 package crank
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"syscall"
 	"time"
+
+	"github.com/pusher/crank/src/api"
 )
 
 // Manager manages multiple process groups
 type Manager struct {
-	build           string
 	name            string
 	configPath      string
+	configHistory   int
 	config          *ProcessConfig
 	socket          *os.File
 	processCount    int
@@ -20,22 +24,42 @@ type Manager struct {
 	actions         chan Action
 	childs          processSet
 	shuttingDown    bool
+	shutdownCount   int
+	detached        bool
+	forcedExit      bool // By the third shutdown request
+	drain           <-chan time.Time
+	shutdownWaiters []*ShutdownAction
+	shutdownSummary []*ShutdownProcessInfo
 	startingTracker *TimeoutTracker
 	stoppingTracker *TimeoutTracker
-	startingReply   *StartReply
-	startingDone    chan<- error
+	clock           Clock
+	generation      int
+	rollout         *rollout
+	hooksRunning    int
+	standbyFailed   bool
+	restarts        []*RestartRecord
+	startQueue      []Action
+	// Automatic restarts, see checkRestarts
+	scheduledFor         string
+	nextScheduledRestart time.Time
+	pendingRestart       *RestartRecord
+	pendingRestartTimer  <-chan time.Time
+	restartBackoffUntil  time.Time
+	keepAlive            bool
+	observers            []LifecycleObserver
+	stopped              chan struct{}
 }
 
-func NewManager(build string, name string, configPath string, socket *os.File) *Manager {
+func NewManager(name string, configPath string, configHistory int, socket *os.File) (*Manager, error) {
 	config, err := loadProcessConfig(configPath)
 	if err != nil {
-		log.Println("Could not load config file: ", err)
+		return nil, fmt.Errorf("Could not load config file: %s", err)
 	}
 
 	manager := &Manager{
-		build:           build,
 		name:            name,
 		configPath:      configPath,
+		configHistory:   configHistory,
 		config:          config,
 		socket:          socket,
 		events:          make(chan Event),
@@ -43,108 +67,161 @@ func NewManager(build string, name string, configPath string, socket *os.File) *
 		childs:          make(processSet),
 		startingTracker: NewTimeoutTracker(),
 		stoppingTracker: NewTimeoutTracker(),
+		clock:           realClock{},
+		stopped:         make(chan struct{}),
 	}
-	return manager
+	return manager, nil
+}
+
+// KeepAlive makes the manager wait for new commands once all its processes
+// are gone, instead of exiting.
+func (self *Manager) KeepAlive(keepAlive bool) {
+	self.keepAlive = keepAlive
 }
 
 // Run starts the event loop for the manager process
 func (self *Manager) Run() {
-	if len(self.config.Command) == 0 {
+	defer close(self.stopped)
+
+	if self.childs.len() > 0 {
+		self.log("Took over %d processes", self.childs.len())
+		self.ensureStandby()
+	} else if len(self.config.Command) == 0 {
 		self.log("Ignoring process start, command is missing")
 	} else {
-		err := self.startProcess(self.config)
-		if err != nil {
-			self.log("Failed to start the process: %s", err)
+		done := make(chan error, 1)
+		self.startRollout(self.config, &RestartRecord{Reason: RESTART_STARTUP}, false, nil, done)
+		if err := <-done; err != nil && !self.keepAlive {
 			return
 		}
 	}
 
 	go self.startingTracker.Run()
 	go self.stoppingTracker.Run()
+	defer self.startingTracker.Stop()
+	defer self.stoppingTracker.Stop()
+
+	restartCheck := time.NewTicker(RESTART_CHECK_INTERVAL)
+	defer restartCheck.Stop()
 
 	for {
+		self.startQueued()
+
 		select {
 		// actions
 		case a := <-self.actions:
 			switch action := a.(type) {
-			case ShutdownAction:
+			case *ShutdownAction:
+				query := action.query
+				self.shutdownCount += 1
 				if self.shuttingDown {
-					self.log("Already shutting down")
+					if query.Wait {
+						self.shutdownWaiters = append(self.shutdownWaiters, action)
+					} else {
+						action.done <- nil
+					}
+					if self.escalateShutdown() {
+						goto exit
+					}
 					continue
 				}
 				self.log("Shutting down")
 				self.shuttingDown = true
+				self.emit(&LifecycleEvent{Type: LIFECYCLE_SHUTDOWN})
+				self.abortRollout(0, errors.New(ERR_SHUTTING_DOWN))
+				self.rejectQueued(errors.New(ERR_SHUTTING_DOWN))
 
 				// Makes the socket unavailable as soon as possible
 				self.socket.Close()
 
-				self.childs.each(func(p *Process) {
-					self.stopProcess(p)
-				})
-				if self.childs.len() == 0 {
+				if query.Wait {
+					self.shutdownWaiters = append(self.shutdownWaiters, action)
+				} else {
+					action.done <- nil
+				}
+
+				if query.Detach {
+					self.log("Detaching from %d processes", self.childs.len())
+					self.detached = true
+					self.childs.each(func(p *Process) {
+						if err := p.relayLog(); err != nil {
+							self.plog(p, "Could not relay the output, the process will fail to write it once crank has exited: %s", err)
+						}
+						self.shutdownSummary = append(self.shutdownSummary, self.newShutdownProcessInfo(p, SHUTDOWN_DETACHED, 0, nil))
+					})
 					goto exit
 				}
-			case *StartAction:
-				query := action.query
-				//reply := action.reply -- not used
 
-				if self.shuttingDown {
-					err := fmt.Errorf("Manager is shutting down")
-					self.log(err.Error())
-					action.done <- err
+				if query.Drain > 0 && self.childs.len() > 0 {
+					self.log("Draining for %v before stopping the processes", query.Drain)
+					self.drain = time.After(query.Drain)
 					continue
 				}
-				if self.childs.starting() != nil {
-					err := fmt.Errorf("New process is already being started")
-					self.log(err.Error())
-					action.done <- err
-					continue
+
+				self.stopAll()
+				if self.finished() {
+					goto exit
 				}
-				if cur := self.childs.ready(); cur != nil && query.Pid > 0 && cur.Pid() != query.Pid {
-					err := fmt.Errorf("Passed pid (%d) doesn't match the current pid (%d)", query.Pid, cur.Pid())
-					self.log(err.Error())
-					action.done <- err
+			case *StartAction:
+				if action.query.Cancel {
+					action.done <- self.cancelRollout(errors.New("Cancelled"))
 					continue
 				}
-
-				config := self.config.clone()
-
-				if len(query.Command) > 0 {
-					config.Command = query.Command
+				if !self.queueStart(action) {
+					self.start(action)
 				}
-
-				if query.Cwd != "" {
-					config.Cwd = query.Cwd
+			case *RollbackAction:
+				if !self.queueStart(action) {
+					self.rollback(action)
 				}
-
-				if query.StartTimeout > 0 {
-					config.StartTimeout = time.Duration(query.StartTimeout) * time.Second
+			case *ScaleAction:
+				replicas := action.query.Replicas
+				if replicas <= 0 {
+					action.done <- fmt.Errorf("Invalid number of replicas: %d", replicas)
+					continue
 				}
-
-				if query.StopTimeout > 0 {
-					config.StopTimeout = time.Duration(query.StopTimeout) * time.Second
+				if self.shuttingDown {
+					action.done <- errors.New(ERR_SHUTTING_DOWN)
+					continue
 				}
 
-				err := self.startProcess(config)
+				self.log("Scaling to %d replicas", replicas)
+				self.config = self.config.clone()
+				self.config.Replicas = replicas
+				self.saveConfig(self.configHistory)
+
+				var err error
+				if self.rollout != nil {
+					self.rollout.config = self.rollout.config.clone()
+					self.rollout.config.Replicas = replicas
+					err = self.reconcile()
+				} else {
+					err = self.scale(replicas)
+				}
+				action.done <- err
+			case *ConfigVersionsAction:
+				versions, err := listConfigVersions(self.configPath)
 				if err != nil {
-					self.log("Failed to start the process: %s", err)
 					action.done <- err
 					continue
 				}
 
-				if query.Wait {
-					self.log("RPC waiting for the process to start")
-					self.startingReply = action.reply
-					self.startingDone = action.done
-				} else {
-					action.done <- nil
+				action.reply.Versions = make([]*ConfigVersion, 0, len(versions))
+				for _, version := range versions {
+					v, err := loadConfigVersion(self.configPath, version)
+					if err != nil {
+						self.log("Skipping config version %d: %s", version, err)
+						continue
+					}
+					action.reply.Versions = append(action.reply.Versions, v)
 				}
-			case *InfoAction:
-				//query := action.query -- not used
-				reply := action.reply
-
-				reply.Info = GetInfo(self.build)
 
+				action.done <- nil
+			case *HistoryAction:
+				for _, r := range self.restarts {
+					record := *r
+					action.reply.Restarts = append(action.reply.Restarts, &record)
+				}
 				action.done <- nil
 			case *PsAction:
 				query := action.query
@@ -157,24 +234,13 @@ func (self *Manager) Run() {
 					})
 				}
 
-				if query.Starting || query.Ready || query.Stopping {
-					ps = ps.choose(func(p *Process, state ProcessState) bool {
-						if query.Starting && (state == PROCESS_STARTING) {
-							return true
-						}
-						if query.Ready && (state == PROCESS_READY) {
-							return true
-						}
-						if query.Stopping && (state == PROCESS_STOPPING) {
-							return true
-						}
-						return false
-					})
+				if states := queryStates(&query.ProcessQuery); states != 0 {
+					ps = ps.all(states)
 				}
 
 				reply.PS = make([]*ProcessInfo, 0, ps.len())
 				for p, state := range ps {
-					reply.PS = append(reply.PS, &ProcessInfo{p.Pid(), p.id, state.String(), p.config.Cwd, p.config.Command})
+					reply.PS = append(reply.PS, newProcessInfo(p, state, self.timeLeft(p)))
 				}
 
 				action.done <- nil
@@ -194,26 +260,15 @@ func (self *Manager) Run() {
 				}
 
 				var ps processSet
-				if query.Starting || query.Ready || query.Stopping || query.Pid > 0 {
+				if queryStates(&query.ProcessQuery) != 0 || query.Pid > 0 {
 					ps = self.childs
 				} else {
 					// Empty set
 					ps = EmptyProcessSet
 				}
 
-				if query.Starting || query.Ready || query.Stopping {
-					ps = ps.choose(func(p *Process, state ProcessState) bool {
-						if query.Starting && (state == PROCESS_STARTING) {
-							return true
-						}
-						if query.Ready && (state == PROCESS_READY) {
-							return true
-						}
-						if query.Stopping && (state == PROCESS_STOPPING) {
-							return true
-						}
-						return false
-					})
+				if states := queryStates(&query.ProcessQuery); states != 0 {
+					ps = ps.all(states)
 				}
 
 				if query.Pid > 0 {
@@ -227,15 +282,97 @@ func (self *Manager) Run() {
 				})
 
 				action.done <- nil
+			case *PauseAction:
+				ps := self.childs.all(PROCESS_READY)
+				if states := queryStates(&action.query.ProcessQuery); states != 0 {
+					ps = self.childs.all(states)
+				} else if action.query.Pid > 0 {
+					ps = self.childs
+				}
+				self.signalProcesses(ps, action.query.Pid, syscall.SIGSTOP, action.reply)
+				action.done <- nil
+			case *ResumeAction:
+				self.signalProcesses(self.childs.all(PROCESS_PAUSED), action.query.Pid, syscall.SIGCONT, action.reply)
+				action.done <- nil
+			case *ConfigGetAction:
+				action.reply.Config = (*api.ProcessConfig)(self.config.clone())
+				action.done <- nil
+			case *ConfigSetAction:
+				config, err := self.config.set(action.query.Values)
+				if err == nil {
+					err = checkPolicy(self.config.Policy, self.config, config)
+				}
+				if err == nil {
+					err = config.validate()
+				}
+				if err != nil {
+					action.done <- err
+					continue
+				}
+
+				self.log("Updating the config: %s", config)
+				// Running processes keep the config they were started with
+				self.config = config
+				if err = self.config.save(self.configPath); err != nil {
+					self.log("Failed saving the config: %s", err)
+				}
+				self.refreshStandby()
+
+				action.reply.Config = (*api.ProcessConfig)(self.config.clone())
+				action.done <- err
+			case *UpgradeAction:
+				state, err := self.upgradeState()
+				if err != nil {
+					action.done <- err
+					continue
+				}
+				*action.reply = *state
+				action.done <- nil
+
+				// Events handled now would be missing from the state
+				<-action.resume
+				self.log("Upgrade aborted, resuming")
+			case *ConfigValidateAction:
+				var config *ProcessConfig
+				var err error
+				if action.query.Name == "" {
+					config, err = loadProcessConfig(self.configPath)
+				} else {
+					config, err = decodeProcessConfig(configFormatFor(action.query.Name), action.query.Data)
+				}
+				if err == nil {
+					err = config.validate()
+				}
+
+				action.done <- err
 			default:
 				fail("Unknown action: ", a)
 			}
 		// timeouts
+		case now := <-restartCheck.C:
+			self.checkRestarts(now)
+		case <-self.pendingRestartTimer:
+			self.startPendingRestart()
+		case <-self.drain:
+			self.drain = nil
+			self.log("Drain period is over")
+			self.stopAll()
 		case process := <-self.startingTracker.timeoutNotification:
+			if self.childs[process] != PROCESS_STARTING {
+				// Ready or gone while being notified
+				continue
+			}
 			self.plog(process, "Killing, did not start in time.")
+			self.emitProcess(LIFECYCLE_PROCESS_KILLED, process, 0, "Did not start in time")
+			process.killed = true
 			process.Kill()
 		case process := <-self.stoppingTracker.timeoutNotification:
+			if self.childs[process] != PROCESS_STOPPING {
+				continue
+			}
 			self.plog(process, "Killing, did not stop in time.")
+			self.emitProcess(LIFECYCLE_PROCESS_KILLED, process, 0, "Did not stop in time")
+			process.killed = true
 			process.Kill()
 		// process state transitions
 		case e := <-self.events:
@@ -244,49 +381,147 @@ func (self *Manager) Run() {
 				process := event.process
 				self.startingTracker.Remove(process)
 
-				if process != self.childs.starting() {
+				if self.childs[process] == PROCESS_PAUSED && process.pausedFrom == PROCESS_STARTING {
+					// Notified right before being paused, it becomes ready
+					// once resumed
+					self.plog(process, "Process is ready, waiting for it to be resumed")
+					process.readyPending = true
+					process.pausedTimeout = 0
+					continue
+				}
+				if self.childs[process] != PROCESS_STARTING {
 					self.plog(process, "Oops, some other process is ready")
 					continue
 				}
-				self.plog(process, "Process is ready")
-
-				current := self.childs.ready()
-				if current != nil {
-					self.plog(current, "Shutting down old current")
-					self.stopProcess(current)
+				self.processReady(process)
+			case *ProcessPausedEvent:
+				process := event.process
+				state, ok := self.childs[process]
+				if !ok || state == PROCESS_PAUSED {
+					continue
 				}
-
-				self.config = process.config
-				err := self.config.save(self.configPath)
-				if err != nil {
-					self.log("Failed saving the config: %s", err)
+				self.plog(process, "Process is paused")
+				process.pausedFrom = state
+				// The timeouts only count while the process runs
+				if left, ok := self.startingTracker.Suspend(process); ok {
+					process.pausedTimeout = left
+				} else if left, ok := self.stoppingTracker.Suspend(process); ok {
+					process.pausedTimeout = left
 				}
-
-				if process == self.childs.starting() && self.startingReply != nil {
-					self.startingDone <- nil
-					self.startingReply = nil
-					self.startingDone = nil
+				self.childs.updateState(process, PROCESS_PAUSED)
+				self.emitProcess(LIFECYCLE_PROCESS_PAUSED, process, 0, "")
+			case *ProcessResumedEvent:
+				process := event.process
+				if self.childs[process] != PROCESS_PAUSED {
+					// Stopped meanwhile, see signalStop
+					process.pausedFrom = 0
+					continue
 				}
-
-				self.childs.updateState(process, PROCESS_READY)
+				self.plog(process, "Process is resumed")
+				self.childs.updateState(process, process.pausedFrom)
+				readyPending := process.readyPending
+				switch {
+				case process.pausedFrom == PROCESS_STARTING && !readyPending:
+					self.startingTracker.Add(process, process.pausedTimeout)
+				case process.pausedFrom == PROCESS_STOPPING:
+					self.stoppingTracker.Add(process, process.pausedTimeout)
+				}
+				process.pausedFrom = 0
+				process.pausedTimeout = 0
+				process.readyPending = false
+				self.emitProcess(LIFECYCLE_PROCESS_RESUMED, process, 0, "")
+				if readyPending {
+					self.processReady(process)
+				} else {
+					self.reconcile()
+				}
+			case *ProcessStatusEvent:
+				event.process.status = event.status
+			case *ProcessExtendTimeoutEvent:
+				self.extendTimeout(event.process, event.extension)
 			case *ProcessExitEvent:
 				process := event.process
 
 				self.startingTracker.Remove(process)
 				self.stoppingTracker.Remove(process)
 
-				if process == self.childs.starting() && self.startingReply != nil {
-					self.startingReply.Code = event.code
-					self.startingDone <- event.err
-					self.startingReply = nil
-					self.startingDone = nil
-				}
-
+				state := self.childs[process]
 				self.childs.rem(process)
 
 				self.plog(process, "Process exited. code=%d err=%v", event.code, event.err)
+				message := ""
+				if event.err != nil {
+					message = event.err.Error()
+				}
+				eventType := LIFECYCLE_PROCESS_EXITED
+				if state != PROCESS_STOPPING && (event.code != 0 || event.err != nil) {
+					eventType = LIFECYCLE_PROCESS_FAILED
+				}
+				self.emitProcess(eventType, process, event.code, message)
+				self.runHook(HOOK_POST_EXIT, process.config, process, process.generation, "CRANK_EXIT_CODE="+strconv.Itoa(event.code))
+
+				if self.shuttingDown {
+					outcome := SHUTDOWN_EXITED
+					if process.killed {
+						outcome = SHUTDOWN_KILLED
+					}
+					self.shutdownSummary = append(self.shutdownSummary, self.newShutdownProcessInfo(process, outcome, event.code, event.err))
+				}
+
+				if self.rollout != nil && state == PROCESS_STARTING && process.generation == self.rollout.generation {
+					self.abortRollout(event.code, event.err)
+				}
 
-				if self.childs.len() == 0 {
+				if process.standby && !self.shuttingDown {
+					self.log("The standby process exited, not replacing it until the next restart")
+					self.standbyFailed = true
+				} else if state&(PROCESS_READY|PROCESS_PAUSED) != 0 && !self.shuttingDown && self.rollout == nil {
+					if p := self.standbyFor(self.config); p != nil {
+						self.promote(p, self.config, self.generation)
+					}
+					// Back up to the configured replicas. Once the last
+					// process is gone crank exits instead, see finished.
+					if self.childs.len() > 0 {
+						if err := self.scale(self.config.replicas()); err != nil {
+							self.log("Failed to replace the process: %s", err)
+						}
+					}
+					self.ensureStandby()
+				} else if state&(PROCESS_READY|PROCESS_PAUSED) != 0 && self.rollout != nil {
+					// Replaces it if it was a new replica, the old ones
+					// are only replaced by the rollout
+					self.reconcile()
+				}
+
+				if self.finished() {
+					goto exit
+				}
+			case *HookEvent:
+				self.hooksRunning -= 1
+				if event.err != nil {
+					self.log("The %s hook failed: %s", event.name, event.err)
+				}
+
+				switch event.name {
+				case HOOK_PRE_START:
+					r := self.rollout
+					if r == nil || r.generation != event.generation {
+						// Aborted in the meantime
+						break
+					}
+					if event.err != nil {
+						self.abortRollout(0, fmt.Errorf("The pre_start hook failed: %s", event.err))
+						break
+					}
+					r.preparing = false
+					self.reconcile()
+				case HOOK_PRE_STOP:
+					if _, ok := self.childs[event.process]; ok {
+						self.signalStop(event.process)
+					}
+				}
+
+				if self.finished() {
 					goto exit
 				}
 			default:
@@ -298,61 +533,339 @@ func (self *Manager) Run() {
 exit:
 
 	// Cleanup
-	self.childs.each(func(p *Process) {
-		p.Kill()
-	})
+	if !self.detached {
+		self.childs.each(func(p *Process) {
+			p.Kill()
+			if self.shuttingDown {
+				self.shutdownSummary = append(self.shutdownSummary, self.newShutdownProcessInfo(p, SHUTDOWN_KILLED, 0, nil))
+			}
+		})
+	}
+
+	self.rejectQueued(errors.New(ERR_STOPPED))
+
+	for _, action := range self.shutdownWaiters {
+		action.reply.Processes = append(action.reply.Processes, self.shutdownSummary...)
+		action.done <- nil
+	}
 }
 
-func (self *Manager) SendAction(action Action) {
-	self.actions <- action
+// Whether the manager exited on the third shutdown request, without waiting
+// for its processes. Only valid once Run has returned.
+func (self *Manager) ForcedExit() bool {
+	return self.forcedExit
+}
+
+// SetClock replaces the clock of the start and stop timeouts. Must be called
+// before Run. Used by the tests.
+func (self *Manager) SetClock(clock Clock) {
+	self.clock = clock
+	self.startingTracker.clock = clock
+	self.stoppingTracker.clock = clock
+}
+
+// Returns false if the manager has stopped and the action was dropped
+func (self *Manager) SendAction(action Action) bool {
+	select {
+	case self.actions <- action:
+		return true
+	case <-self.stopped:
+		return false
+	}
 }
 
 // Restart queues and starts excecuting a restart job to replace the old process group with a new one.
 func (self *Manager) Reload() {
-	done := make(chan error)
-	self.SendAction(&StartAction{&StartQuery{}, nil, done})
-	<-done
+	done := make(chan error, 1)
+	if self.SendAction(&StartAction{&StartQuery{}, &StartReply{}, done}) {
+		<-done
+	}
 }
 
 func (self *Manager) Shutdown() {
-	self.SendAction(ShutdownAction(true))
+	done := make(chan error, 1)
+	self.SendAction(&ShutdownAction{&ShutdownQuery{}, &ShutdownReply{}, done})
 }
 
 // Private methods
 
-func (_ *Manager) log(format string, v ...interface{}) {
+func (self *Manager) log(format string, v ...interface{}) {
+	if self.name != "" {
+		log.Printf("[manager:"+self.name+"] "+format, v...)
+		return
+	}
 	log.Printf("[manager] "+format, v...)
 }
 
-func (m *Manager) plog(p *Process, format string, v ...interface{}) {
+func (self *Manager) plog(p *Process, format string, v ...interface{}) {
 	args := make([]interface{}, 1, 1+len(v))
 	args[0] = p
 	args = append(args, v...)
+	if self.name != "" {
+		log.Printf("[%s] %s "+format, append([]interface{}{self.name}, args...)...)
+		return
+	}
 	log.Printf("%s "+format, args...)
 }
 
-func (self *Manager) startProcess(config *ProcessConfig) error {
+// Handles crankctl run
+func (self *Manager) start(action *StartAction) {
+	query := action.query
+
+	if err := self.checkStart(query.Pid); err != nil {
+		action.done <- err
+		return
+	}
+
+	config := self.config.clone()
+
+	if len(query.Command) > 0 {
+		config.Command = query.Command
+	}
+
+	if query.Cwd != "" {
+		config.Cwd = query.Cwd
+	}
+
+	if query.StartTimeout > 0 {
+		config.StartTimeout = Duration(time.Duration(query.StartTimeout) * time.Second)
+	}
+
+	if query.StopTimeout > 0 {
+		config.StopTimeout = Duration(time.Duration(query.StopTimeout) * time.Second)
+	}
+
+	if err := checkPolicy(self.config.Policy, self.config, config); err != nil {
+		self.log("Rejecting process start: %s", err)
+		action.done <- err
+		return
+	}
+
+	self.startRollout(config, &RestartRecord{Reason: RESTART_RUN}, query.Wait, action.reply, action.done)
+}
+
+// Handles crankctl rollback
+func (self *Manager) rollback(action *RollbackAction) {
+	query := action.query
+
+	if err := self.checkStart(query.Pid); err != nil {
+		action.done <- err
+		return
+	}
+
+	version := query.Version
+	if version <= 0 {
+		// The latest version is normally the running config
+		versions, err := listConfigVersions(self.configPath)
+		if err != nil {
+			action.done <- err
+			return
+		}
+		if len(versions) < 2 {
+			action.done <- fmt.Errorf("No previous config version to roll back to")
+			return
+		}
+		version = versions[len(versions)-2]
+	}
+
+	v, err := loadConfigVersion(self.configPath, version)
+	if err != nil {
+		action.done <- err
+		return
+	}
+
+	// Old versions don't get to loosen the policy
+	config := (*ProcessConfig)(v.Config)
+	config.Policy = self.config.Policy
+	if err = checkPolicy(self.config.Policy, self.config, config); err != nil {
+		self.log("Rejecting rollback: %s", err)
+		action.done <- err
+		return
+	}
+
+	self.log("Rolling back to config version %d", version)
+	self.startRollout(config, &RestartRecord{Reason: RESTART_ROLLBACK, Message: fmt.Sprintf("To config version %d", version)}, query.Wait, action.reply, action.done)
+}
+
+// Returns an error if a new process can't be started right now. If pid is
+// given it needs to match one of the ready processes.
+func (self *Manager) checkStart(pid int) (err error) {
+	ready := self.childs.all(PROCESS_READY)
+	if self.shuttingDown {
+		err = errors.New(ERR_SHUTTING_DOWN)
+	} else if self.rollout != nil {
+		err = errors.New(ERR_START_IN_PROGRESS)
+	} else if pid > 0 && ready.len() > 0 && ready.choose(func(p *Process, _ ProcessState) bool { return p.Pid() == pid }).len() == 0 {
+		if cur := ready.find(PROCESS_READY); ready.len() == 1 {
+			err = fmt.Errorf("%s (%d) doesn't match the current pid (%d)", ERR_PID_MISMATCH, pid, cur.Pid())
+		} else {
+			err = fmt.Errorf("%s (%d) doesn't match any of the ready pids", ERR_PID_MISMATCH, pid)
+		}
+	}
+	if err != nil {
+		self.log(err.Error())
+	}
+	return
+}
+
+func (self *Manager) startProcess(config *ProcessConfig, generation int, standby bool) error {
 	self.log("Starting a new process: %s", config)
-	if len(config.Command) == 0 {
-		return fmt.Errorf("Command is missing")
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	var env []string
+	if standby {
+		env = append(env, "CRANK_STANDBY=1")
 	}
 
 	self.processCount += 1
-	process, err := startProcess(self.processCount, self.name, config, self.socket, self.events)
+	process, err := startProcess(self.processCount, self.name, config, self.socket, self.events, env...)
 	if err != nil {
 		return err
 	}
+	process.generation = generation
+	process.standby = standby
 
 	self.childs.add(process, PROCESS_STARTING)
-	self.startingTracker.Add(process, process.config.StartTimeout)
+	process.timeoutSince = self.clock.Now()
+	// Before the event so that observers see the deadline
+	self.startingTracker.Add(process, time.Duration(process.config.StartTimeout))
+	self.emitProcess(LIFECYCLE_PROCESS_STARTED, process, 0, "")
 	return nil
 }
 
+// Called when a shutdown is requested again. The second request kills the
+// processes without waiting for their stop timeout, the third one gives up
+// on them. Returns true if the manager should exit now.
+func (self *Manager) escalateShutdown() bool {
+	if self.shutdownCount == 2 {
+		self.log("Shutdown requested again, killing %d processes", self.childs.len())
+		self.emit(&LifecycleEvent{Type: LIFECYCLE_SHUTDOWN_KILL})
+		self.drain = nil
+		self.childs.each(self.killProcess)
+		return false
+	}
+	self.log("Shutdown requested %d times, exiting now", self.shutdownCount)
+	self.emit(&LifecycleEvent{Type: LIFECYCLE_SHUTDOWN_EXIT})
+	self.forcedExit = true
+	return true
+}
+
+func (self *Manager) stopAll() {
+	self.childs.each(func(p *Process) {
+		self.stopProcess(p)
+	})
+}
+
+// Handles EXTEND_TIMEOUT_USEC. The start or stop timeout of the process is
+// pushed back to at least extension from now, but no later than
+// max_extend_timeout after it entered its state.
+func (self *Manager) extendTimeout(process *Process, extension time.Duration) {
+	var tracker *TimeoutTracker
+	switch self.childs[process] {
+	case PROCESS_STARTING:
+		tracker = self.startingTracker
+	case PROCESS_STOPPING:
+		tracker = self.stoppingTracker
+	default:
+		return
+	}
+
+	deadline := self.clock.Now().Add(extension)
+	if max := time.Duration(process.config.MaxExtendTimeout); max > 0 {
+		if limit := process.timeoutSince.Add(max); deadline.After(limit) {
+			deadline = limit
+		}
+	}
+	tracker.Extend(process, deadline)
+}
+
+// Returns when the process will be killed if it doesn't start or stop, or
+// false if it's not starting nor stopping
+func (self *Manager) deadline(process *Process) (time.Time, bool) {
+	if deadline, ok := self.startingTracker.Deadline(process); ok {
+		return deadline, true
+	}
+	return self.stoppingTracker.Deadline(process)
+}
+
+// Returns the time left before the process is killed if it doesn't start or
+// stop, or 0 if it's neither starting nor stopping
+func (self *Manager) timeLeft(process *Process) time.Duration {
+	deadline, ok := self.deadline(process)
+	if !ok {
+		return 0
+	}
+	if left := deadline.Sub(self.clock.Now()); left > 0 {
+		return left
+	}
+	return time.Millisecond // Being killed
+}
+
+// Kills the process right away, without the pre_stop hook
+func (self *Manager) killProcess(process *Process) {
+	self.startingTracker.Remove(process)
+	self.stoppingTracker.Remove(process)
+	self.childs.updateState(process, PROCESS_STOPPING)
+	process.killed = true
+	process.Kill()
+}
+
+// The process is only signalled once the pre_stop hook is done
 func (self *Manager) stopProcess(process *Process) {
 	if self.childs[process] == PROCESS_STOPPING {
 		return
 	}
-	process.Shutdown()
-	self.stoppingTracker.Add(process, process.config.StopTimeout)
 	self.childs.updateState(process, PROCESS_STOPPING)
+	if !self.runHook(HOOK_PRE_STOP, process.config, process, process.generation) {
+		self.signalStop(process)
+	}
+}
+
+func (self *Manager) signalStop(process *Process) {
+	process.Shutdown()
+	if process.pausedFrom != 0 {
+		// Lets it handle the SIGTERM
+		process.Signal(syscall.SIGCONT)
+	}
+	process.timeoutSince = self.clock.Now()
+	self.stoppingTracker.Add(process, time.Duration(process.config.StopTimeout))
+}
+
+// Sends the signal to the processes, or only to pid if given, and reports
+// them in reply. Their state changes once the manager gets the wait status.
+func (self *Manager) signalProcesses(ps processSet, pid int, sig syscall.Signal, reply *PauseReply) {
+	for p := range ps {
+		if pid > 0 && p.Pid() != pid {
+			continue
+		}
+		if err := p.Signal(sig); err != nil {
+			self.plog(p, "Failed to send %s: %s", sig, err)
+			continue
+		}
+		reply.Pids = append(reply.Pids, p.Pid())
+	}
+}
+
+// True once the manager has nothing left to look after
+// Moves a starting process to READY, or STANDBY for a standby
+func (self *Manager) processReady(process *Process) {
+	if process.standby {
+		self.plog(process, "Standby process is ready")
+		self.childs.updateState(process, PROCESS_STANDBY)
+		self.emitProcess(LIFECYCLE_PROCESS_STANDBY, process, 0, "")
+		return
+	}
+	self.plog(process, "Process is ready")
+	process.readyAt = time.Now()
+	self.childs.updateState(process, PROCESS_READY)
+	self.emitProcess(LIFECYCLE_PROCESS_READY, process, 0, "")
+	self.runHook(HOOK_POST_READY, process.config, process, process.generation)
+
+	self.reconcile()
+}
+
+func (self *Manager) finished() bool {
+	return self.childs.len() == 0 && self.hooksRunning == 0 && (self.shuttingDown || !self.keepAlive)
 }
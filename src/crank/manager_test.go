@@ -0,0 +1,271 @@
+package crank_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+	"github.com/pusher/crank/src/cranktest"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(cranktest.Main(m))
+}
+
+func testConfig(command ...string) *crank.ProcessConfig {
+	return &crank.ProcessConfig{
+		Command:      cranktest.Child(command...),
+		StartTimeout: crank.Duration(30 * time.Second),
+		StopTimeout:  crank.Duration(30 * time.Second),
+	}
+}
+
+func TestManagerStart(t *testing.T) {
+	h := cranktest.New(t, testConfig())
+
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+	h.WaitState(pid, "READY")
+	if got := h.Dial(); got != pid {
+		t.Errorf("Expected pid=%d to answer, got %d", pid, got)
+	}
+}
+
+func TestManagerRelativeCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank-cwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	command := cranktest.Child()
+	if err = os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(command[0], filepath.Join(dir, "bin", "server")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig()
+	config.Cwd = dir
+	config.Command = []string{"bin/server"}
+	h := cranktest.New(t, config)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+	if got := h.Dial(); got != pid {
+		t.Errorf("Expected pid=%d to answer, got %d", pid, got)
+	}
+}
+
+func TestManagerListenEnv(t *testing.T) {
+	// As if crank was started by systemd without a systemd:// socket
+	defer os.Unsetenv("LISTEN_FDS")
+	os.Setenv("LISTEN_FDS", "2")
+	h := cranktest.New(t, testConfig("-env-status", "LISTEN_FDS"))
+
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid
+	h.WaitStatus(pid, "1")
+}
+
+func TestManagerRestart(t *testing.T) {
+	h := cranktest.New(t, testConfig())
+	old := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	var reply crank.StartReply
+	h.Call("crank.Run", &crank.StartQuery{Wait: true}, &reply)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+	if pid == old {
+		t.Fatalf("Expected a new process, got pid=%d again", pid)
+	}
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_COMPLETED)
+	h.WaitState(old, "")
+	if got := h.Dial(); got != pid {
+		t.Errorf("Expected pid=%d to answer, got %d", pid, got)
+	}
+}
+
+func TestManagerStartTimeout(t *testing.T) {
+	h := cranktest.New(t, testConfig())
+	old := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	var reply crank.StartReply
+	done := h.Go("crank.Run", &crank.StartQuery{Command: cranktest.Child("-ready-after", "-1s"), Wait: true}, &reply)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid
+
+	h.Advance(29 * time.Second)
+	pi := h.Process(pid)
+	if pi == nil || pi.State != "STARTING" || pi.TimeLeft != time.Second {
+		t.Fatalf("Expected pid=%d to be starting with 1s left, got %v", pid, pi)
+	}
+
+	h.Advance(time.Second)
+	if event := h.WaitEvent(crank.LIFECYCLE_PROCESS_KILLED); event.Pid != pid {
+		t.Errorf("Expected pid=%d to be killed, got %s", pid, event)
+	}
+	if err := <-done; err == nil {
+		t.Error("Expected the start to fail")
+	}
+	h.WaitState(pid, "")
+	if pi := h.Process(old); pi == nil || pi.State != "READY" {
+		t.Errorf("Expected pid=%d to still be ready, got %v", old, pi)
+	}
+}
+
+func TestManagerMaxExtendTimeout(t *testing.T) {
+	config := testConfig("-ready-after", "-1s", "-extend", "10m", "-extend-on-cont", "-status", "started")
+	config.MaxExtendTimeout = crank.Duration(time.Minute)
+	h := cranktest.New(t, config)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid
+	h.WaitStatus(pid, "started")
+	if pi := h.Process(pid); pi == nil || pi.TimeLeft != time.Minute {
+		t.Fatalf("Expected the extension to be capped to 1m, got %v", pi)
+	}
+
+	// Pausing doesn't restart the cap
+	h.Advance(40 * time.Second)
+	h.Call("crank.Pause", &crank.PauseQuery{ProcessQuery: crank.ProcessQuery{Pid: pid}}, &crank.PauseReply{})
+	h.WaitState(pid, "PAUSED")
+	h.Call("crank.Resume", &crank.PauseQuery{ProcessQuery: crank.ProcessQuery{Pid: pid}}, &crank.PauseReply{})
+	h.WaitStatus(pid, "continued")
+	if pi := h.Process(pid); pi == nil || pi.TimeLeft != 20*time.Second {
+		t.Fatalf("Expected 20s left after the pause, got %v", pi)
+	}
+
+	h.Advance(20 * time.Second)
+	if event := h.WaitEvent(crank.LIFECYCLE_PROCESS_KILLED); event.Pid != pid {
+		t.Errorf("Expected pid=%d to be killed, got %s", pid, event)
+	}
+}
+
+func TestManagerStopTimeout(t *testing.T) {
+	h := cranktest.New(t, testConfig("-ignore-term"))
+	old := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	var reply crank.StartReply
+	h.Call("crank.Run", &crank.StartQuery{Command: cranktest.Child(), Wait: true}, &reply)
+	h.WaitState(old, "STOPPING")
+
+	h.Advance(30 * time.Second)
+	if event := h.WaitEvent(crank.LIFECYCLE_PROCESS_KILLED); event.Pid != old {
+		t.Errorf("Expected pid=%d to be killed, got %s", old, event)
+	}
+	h.WaitState(old, "")
+}
+
+func TestManagerFailedStart(t *testing.T) {
+	h := cranktest.New(t, testConfig())
+	old := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	var reply crank.StartReply
+	query := &crank.StartQuery{
+		Command: cranktest.Child("-ready-after", "-1s", "-exit-after", "0s", "-code", "3"),
+		Wait:    true,
+	}
+	h.Call("crank.Run", query, &reply)
+	if reply.Code != 3 {
+		t.Errorf("Expected the exit code 3, got %d", reply.Code)
+	}
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_FAILED)
+	if pi := h.Process(old); pi == nil || pi.State != "READY" {
+		t.Errorf("Expected pid=%d to still be ready, got %v", old, pi)
+	}
+}
+
+func TestManagerShutdownEscalation(t *testing.T) {
+	config := testConfig("-ignore-term")
+	// Keeps the manager around once its process is killed
+	config.Hooks = &crank.ProcessHooks{PreStop: &crank.Hook{Command: []string{"sleep", "5"}}}
+	h := cranktest.New(t, config)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+
+	h.Call("crank.Shutdown", &crank.ShutdownQuery{}, &crank.ShutdownReply{})
+	h.WaitEvent(crank.LIFECYCLE_SHUTDOWN)
+	h.WaitState(pid, "STOPPING")
+
+	h.Call("crank.Shutdown", &crank.ShutdownQuery{}, &crank.ShutdownReply{})
+	h.WaitEvent(crank.LIFECYCLE_SHUTDOWN_KILL)
+	h.WaitState(pid, "")
+	if h.Manager.ForcedExit() {
+		t.Error("Expected the manager to wait for the pre_stop hook")
+	}
+
+	h.Call("crank.Shutdown", &crank.ShutdownQuery{}, &crank.ShutdownReply{})
+	h.WaitEvent(crank.LIFECYCLE_SHUTDOWN_EXIT)
+	h.Close()
+	if !h.Manager.ForcedExit() {
+		t.Error("Expected a forced exit")
+	}
+}
+
+func TestManagerRolloutReplacesDeadReplica(t *testing.T) {
+	config := testConfig()
+	config.Replicas = 2
+	config.RollingBatch = 1
+	h := cranktest.New(t, config)
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_COMPLETED)
+
+	h.Call("crank.Run", &crank.StartQuery{}, &crank.StartReply{})
+	replaced := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+	starting := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid
+	// Holds the rollout, the paused replica doesn't count as starting
+	h.Call("crank.Pause", &crank.PauseQuery{ProcessQuery: crank.ProcessQuery{Pid: starting}}, &crank.PauseReply{})
+	h.WaitState(starting, "PAUSED")
+
+	h.Call("crank.Kill", &crank.KillQuery{ProcessQuery: crank.ProcessQuery{Pid: replaced}, Signal: "SIGKILL"}, &crank.KillReply{})
+	h.WaitEvent(crank.LIFECYCLE_PROCESS_FAILED)
+	if pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid; pid == starting {
+		t.Errorf("Expected a new replica, got pid=%d", pid)
+	}
+}
+
+func TestManagerReadyWhilePaused(t *testing.T) {
+	h := cranktest.New(t, testConfig("-ready-after", "-1s", "-helper-ready-after", "500ms"))
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_STARTED).Pid
+	h.WaitStatus(pid, "helper started")
+
+	h.Call("crank.Pause", &crank.PauseQuery{ProcessQuery: crank.ProcessQuery{Pid: pid}}, &crank.PauseReply{})
+	h.WaitState(pid, "PAUSED")
+	// The helper notifies READY=1 meanwhile
+	time.Sleep(time.Second)
+	if pi := h.Process(pid); pi == nil || pi.State != "PAUSED" {
+		t.Fatalf("Expected pid=%d to stay paused, got %v", pid, pi)
+	}
+
+	h.Call("crank.Resume", &crank.PauseQuery{ProcessQuery: crank.ProcessQuery{Pid: pid}}, &crank.PauseReply{})
+	h.WaitEvent(crank.LIFECYCLE_PROCESS_RESUMED)
+	if event := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY); event.Pid != pid {
+		t.Errorf("Expected pid=%d to be ready, got %s", pid, event)
+	}
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_COMPLETED)
+	h.WaitState(pid, "READY")
+}
+
+func TestManagerReplacesDeadReplica(t *testing.T) {
+	config := testConfig()
+	config.Replicas = 2
+	h := cranktest.New(t, config)
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_COMPLETED)
+	dead := h.Ps()[0].Pid
+
+	h.Call("crank.Kill", &crank.KillQuery{ProcessQuery: crank.ProcessQuery{Pid: dead}, Signal: "SIGKILL"}, &crank.KillReply{})
+	h.WaitEvent(crank.LIFECYCLE_PROCESS_FAILED)
+	pid := h.WaitEvent(crank.LIFECYCLE_PROCESS_READY).Pid
+	if pid == dead {
+		t.Fatalf("Expected a new replica, got pid=%d", pid)
+	}
+	if ps := h.Ps(); len(ps) != 2 {
+		t.Errorf("Expected 2 replicas, got %v", ps)
+	}
+}
+
+func TestManagerScaleSavesVersion(t *testing.T) {
+	h := cranktest.New(t, testConfig())
+	h.WaitEvent(crank.LIFECYCLE_ROLLOUT_COMPLETED)
+
+	h.Call("crank.Scale", &crank.ScaleQuery{Replicas: 2}, &crank.ScaleReply{})
+	var reply crank.ConfigVersionsReply
+	h.Call("crank.ConfigVersions", &crank.ConfigVersionsQuery{}, &reply)
+	if n := len(reply.Versions); n != 2 || reply.Versions[n-1].Config.Replicas != 2 {
+		t.Errorf("Expected a version with 2 replicas, got %v", reply.Versions)
+	}
+}
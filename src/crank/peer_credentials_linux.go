@@ -0,0 +1,50 @@
+package crank
+
+import (
+	"net"
+	"syscall"
+)
+
+func readPeerCredentials(conn *net.UnixConn) (*peerCredentials, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &peerCredentials{
+		pid:  int(ucred.Pid),
+		uid:  int(ucred.Uid),
+		gids: []int{int(ucred.Gid)},
+	}
+	// SO_PEERCRED only has the primary group. The supplementary ones are
+	// also those of the peer when it connected, /proc could already show
+	// another process reusing its pid.
+	var groups []int
+	err = raw.Control(func(fd uintptr) {
+		groups, credErr = getsockoptPeerGroups(int(fd))
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err == syscall.ENOPROTOOPT {
+		// Before linux 4.13, only the primary group is checked
+		return cred, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cred.gids = append(cred.gids, groups...)
+	return cred, nil
+}
@@ -0,0 +1,50 @@
+package crank
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPeerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank-peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cred, err := readPeerCredentials(conn.(*net.UnixConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.pid != os.Getpid() || cred.uid != os.Getuid() || cred.gids[0] != os.Getgid() {
+		t.Errorf("got %+v", cred)
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gid := range groups {
+		if !intIn(gid, cred.gids) {
+			t.Errorf("missing the supplementary group %d in %v", gid, cred.gids)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package crank
+
+import (
+	"fmt"
+	"net"
+)
+
+func readPeerCredentials(conn *net.UnixConn) (*peerCredentials, error) {
+	return nil, fmt.Errorf("Peer credentials are only available on linux")
+}
@@ -0,0 +1,37 @@
+//go:build linux && !386
+// +build linux,!386
+
+package crank
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Missing from the syscall package
+const soPeerGroups = 0x3b
+
+// Returns the supplementary groups of the peer of a unix socket, as they
+// were when it connected
+func getsockoptPeerGroups(fd int) ([]int, error) {
+	buf := make([]uint32, 32)
+	for {
+		size := uint32(len(buf) * 4)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soPeerGroups,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno == syscall.ERANGE {
+			// size is now the one needed
+			buf = make([]uint32, size/4)
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+
+		groups := make([]int, size/4)
+		for i := range groups {
+			groups[i] = int(buf[i])
+		}
+		return groups, nil
+	}
+}
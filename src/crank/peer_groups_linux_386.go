@@ -0,0 +1,11 @@
+package crank
+
+import (
+	"syscall"
+)
+
+// getsockopt(2) goes through socketcall(2) on 386, which the syscall
+// package doesn't expose. Only the primary group is checked there.
+func getsockoptPeerGroups(fd int) ([]int, error) {
+	return nil, syscall.ENOPROTOOPT
+}
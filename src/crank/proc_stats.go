@@ -0,0 +1,11 @@
+package crank
+
+import (
+	"time"
+)
+
+// Resource usage of a running process, as seen by the kernel.
+type procStats struct {
+	RSS     ByteCount
+	CPUTime time.Duration
+}
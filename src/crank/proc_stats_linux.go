@@ -0,0 +1,74 @@
+package crank
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// USER_HZ is 100 on all the platforms we care about. Reading the real value
+// would require sysconf(_SC_CLK_TCK) and thus cgo.
+const clockTicks = 100
+
+func readProcStats(pid int) (stats *procStats, err error) {
+	stats = new(procStats)
+
+	// See proc(5) for the format of both files
+	statm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return
+	}
+	if stats.RSS, err = parseProcStatm(statm, os.Getpagesize()); err != nil {
+		return nil, err
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return
+	}
+	if stats.CPUTime, err = parseProcStat(stat); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Returns the resident set size from the second field of /proc/<pid>/statm,
+// which is counted in pages.
+func parseProcStatm(statm []byte, pageSize int) (rss ByteCount, err error) {
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("Unexpected statm format: %q", statm)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	return ByteCount(pages * int64(pageSize)), nil
+}
+
+// Returns the user and system CPU time from /proc/<pid>/stat
+func parseProcStat(stat []byte) (cpuTime time.Duration, err error) {
+	// The command name is in parens and can contain spaces
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("Unexpected stat format: %q", stat)
+	}
+	// Fields after the command, starting with the state (field 3)
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("Unexpected stat format: %q", stat)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64) // field 14
+	if err != nil {
+		return
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64) // field 15
+	if err != nil {
+		return
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicks, nil
+}
@@ -0,0 +1,48 @@
+package crank
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		stat    string
+		cpuTime time.Duration
+		err     bool
+	}{
+		{"1234 (sleep) S 1 1234 1234 0 -1 4194304 94 0 0 0 150 25 0 0 20 0 1 0 5871 8429568 129 18446744073709551615", 1750 * time.Millisecond, false},
+		// The command can contain spaces and parens
+		{"1234 (a b) c) R 1 1234 1234 0 -1 4194304 94 0 0 0 7 3 0 0 20 0 1 0 5871 8429568 129", 100 * time.Millisecond, false},
+		{"1234 (sleep) S 1 1234", 0, true},
+		{"1234 sleep S 1 1234 1234 0 -1 4194304 94 0 0 0 150 25", 0, true},
+		{"1234 (sleep) S 1 1234 1234 0 -1 4194304 94 0 0 0 x 25", 0, true},
+	}
+	for _, test := range tests {
+		cpuTime, err := parseProcStat([]byte(test.stat))
+		if (err != nil) != test.err || cpuTime != test.cpuTime {
+			t.Errorf("%q: got %v, %v", test.stat, cpuTime, err)
+		}
+	}
+}
+
+func TestParseProcStatm(t *testing.T) {
+	rss, err := parseProcStatm([]byte("2058 129 112 5 0 110 0\n"), 4096)
+	if err != nil || rss != 129*4096 {
+		t.Error(rss, err)
+	}
+	if _, err := parseProcStatm([]byte("2058"), 4096); err == nil {
+		t.Error("expected an error for a truncated statm")
+	}
+}
+
+func TestReadProcStats(t *testing.T) {
+	stats, err := readProcStats(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RSS <= 0 {
+		t.Error("the test process uses some memory", stats.RSS)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package crank
+
+import (
+	"fmt"
+)
+
+func readProcStats(pid int) (*procStats, error) {
+	return nil, fmt.Errorf("Process stats are only available on linux")
+}
@@ -1,23 +1,29 @@
 package crank
 
 import (
+	"errors"
 	"fmt"
 	"github.com/pusher/crank/src/devnull"
+	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
-func startProcess(id int, name string, config *ProcessConfig, bindSocket *os.File, events chan<- Event) (p *Process, err error) {
+func startProcess(id int, name string, config *ProcessConfig, bindSocket *os.File, events chan<- Event, extraEnv ...string) (p *Process, err error) {
 	var (
-		stdin        *os.File
-		notifySocket *os.File
-		logFile      *os.File
-		ready        chan bool
+		stdin         *os.File
+		notifySocket  *os.File
+		notifyReader  *os.File
+		logFile       *os.File
+		logReader     *os.File
+		notifications chan notification
 	)
 
-	ready = make(chan bool)
+	notifications = make(chan notification)
 
 	lock := make(chan bool)
 	defer close(lock)
@@ -26,31 +32,38 @@ func startProcess(id int, name string, config *ProcessConfig, bindSocket *os.Fil
 		return
 	}
 
-	if notifySocket, err = startProcessNotifier(ready); err != nil {
+	if notifyReader, notifySocket, err = startProcessNotifier(notifications); err != nil {
 		return
 	}
 	defer notifySocket.Close()
 
 	prefix := func() string {
 		<-lock // once the channel is closed this will never block
+		if name != "" {
+			return fmt.Sprintf("%s [%s] %s ", time.Now().Format(time.StampMilli), name, p.String())
+		}
 		return fmt.Sprintf("%s %s ", time.Now().Format(time.StampMilli), p.String())
 	}
-	if logFile, err = startProcessLogger(os.Stdout, prefix); err != nil {
+	if logReader, logFile, err = startProcessLogger(os.Stdout, prefix); err != nil {
 		return
 	}
 	defer logFile.Close()
 
 	p = &Process{
-		id:     id,
-		config: config,
+		id:           id,
+		config:       config,
+		startedAt:    time.Now(),
+		notifyReader: notifyReader,
+		logReader:    logReader,
 	}
 
-	env := os.Environ()
+	env := processEnviron()
 	env = append(env, "LISTEN_FDS=1")
 	env = append(env, "NOTIFY_FD=4")
 	if name != "" {
 		env = append(env, "CRANK_NAME="+name)
 	}
+	env = append(env, extraEnv...)
 
 	procAttr := os.ProcAttr{
 		Dir: config.Cwd,
@@ -65,7 +78,7 @@ func startProcess(id int, name string, config *ProcessConfig, bindSocket *os.Fil
 	}
 
 	// Start process
-	command, err := exec.LookPath(config.Command[0])
+	command, err := config.lookCommand()
 	if err != nil {
 		return nil, err
 	}
@@ -74,42 +87,120 @@ func startProcess(id int, name string, config *ProcessConfig, bindSocket *os.Fil
 		return nil, err
 	}
 
-	// Goroutine catches process exit
+	p.watch(notifications, events)
+
+	return p, nil
+}
+
+// Variables set by startProcess, which must not be inherited from crank's
+// environment
+var processEnv = []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "NOTIFY_FD", "CRANK_NAME"}
+
+// Returns crank's environment without processEnv
+func processEnviron() (env []string) {
+	for _, kv := range os.Environ() {
+		if !stringIn(strings.SplitN(kv, "=", 2)[0], processEnv) {
+			env = append(env, kv)
+		}
+	}
+	return
+}
+
+// Starts the goroutines turning the exit and notifications of the process
+// into events
+func (p *Process) watch(notifications <-chan notification, events chan<- Event) {
+	// Goroutine catches process exit, and stops and continues so that
+	// SIGSTOP and SIGCONT sent by anybody are noticed
 	go func() {
 		for {
-			ps, err := p.Wait()
-			// Make sure we don't shutdown if the process is paused
-			if ps != nil && !ps.Exited() {
+			var status syscall.WaitStatus
+			_, err := syscall.Wait4(p.Pid(), &status, syscall.WUNTRACED|syscall.WCONTINUED, nil)
+			if err == syscall.EINTR {
 				continue
 			}
-			code, err2 := getExitStatusCode(ps, err)
-			events <- &ProcessExitEvent{p, code, err2}
-			return
+			if err == syscall.ECHILD && p.adopted {
+				log.Printf("%s Exited during the upgrade, the previous crank reaped it", p)
+				events <- &ProcessExitEvent{p, 0, errExitStatusLost}
+				return
+			}
+			if err != nil {
+				events <- &ProcessExitEvent{p, 0, os.NewSyscallError("wait", err)}
+				return
+			}
+
+			switch {
+			case status.Stopped():
+				events <- &ProcessPausedEvent{p}
+			case status.Continued():
+				events <- &ProcessResumedEvent{p}
+			default:
+				code, err := getExitStatusCode(status)
+				events <- &ProcessExitEvent{p, code, err}
+				return
+			}
 		}
 	}()
 
-	// Goroutine that transforms ready events
+	// Goroutine that transforms notifications into events
 	go func() {
-		for {
-			select {
-			case v := <-ready:
-				if !v { // Channel closed
-					return
+		for n := range notifications {
+			switch n.key {
+			case "READY":
+				if n.value == "1" {
+					events <- &ProcessReadyEvent{p}
+				}
+			case "STATUS":
+				events <- &ProcessStatusEvent{p, n.value}
+			case "EXTEND_TIMEOUT_USEC":
+				usec, err := strconv.ParseUint(n.value, 10, 63)
+				if err != nil {
+					log.Printf("%s Invalid notification: %s=%s", p, n.key, n.value)
+					continue
 				}
-				events <- &ProcessReadyEvent{p}
+				events <- &ProcessExtendTimeoutEvent{p, time.Duration(usec) * time.Microsecond}
+			default:
+				log.Printf("%s Unknown notification: %s=%s", p, n.key, n.value)
 			}
 		}
 	}()
-
-	return p, nil
 }
 
 type Process struct {
 	*os.Process
 	id     int
 	config *ProcessConfig
+	// Processes started by the same rollout share a generation
+	generation int
+	// Until promoted
+	standby bool
+	// Taken over from the previous crank on upgrade
+	adopted bool
+
+	// Read by the notifier and logger goroutines. Kept to hand them over to
+	// a new crank on upgrade.
+	notifyReader *os.File
+	logReader    *os.File
+
+	// Bookkeeping, only accessed from the manager's goroutine
+	startedAt  time.Time
+	readyAt    time.Time
+	stateSince time.Time
+	// When the start or stop timeout began by the manager's clock, pauses
+	// included. Bounds EXTEND_TIMEOUT_USEC, see max_extend_timeout.
+	timeoutSince time.Time
+	status       string
+	killed       bool // After a timeout
+	// Set while paused
+	pausedFrom    ProcessState
+	pausedTimeout time.Duration // Left on the start or stop timeout
+	readyPending  bool          // Notified READY=1 while paused from STARTING
 }
 
+// A process that exits while an upgrade freezes the event loop is reaped by
+// the Wait4 of the previous crank. The new crank then gets ECHILD instead of
+// its exit status.
+var errExitStatusLost = errors.New("Exited during the upgrade, the exit status is lost")
+
 func (p *Process) Pid() int {
 	if p.Process == nil {
 		return -1
@@ -126,15 +217,24 @@ func (p *Process) Shutdown() error {
 	return p.Signal(syscall.SIGTERM)
 }
 
-func getExitStatusCode(ps *os.ProcessState, err error) (int, error) {
-	if ps == nil || err != nil {
-		return 0, err
+// Hands the read end of the log pipe to a cat process that outlives crank.
+// Without a reader the detached process would get EPIPE or SIGPIPE on its
+// next write. Its output then goes to crank's stdout without a prefix.
+func (p *Process) relayLog() error {
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		return err
 	}
+	cmd := exec.Command(cat)
+	cmd.Stdin = p.logReader
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Start()
+}
 
-	status, ok := ps.Sys().(syscall.WaitStatus)
-	if !ok {
-		return 0, fmt.Errorf("BUG, not a syscall.WaitStatus")
+func getExitStatusCode(status syscall.WaitStatus) (int, error) {
+	if status.Signaled() {
+		return status.ExitStatus(), fmt.Errorf("signal: %s", status.Signal())
 	}
-
 	return status.ExitStatus(), nil
 }
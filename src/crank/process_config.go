@@ -1,53 +1,226 @@
 package crank
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"time"
+
+	"github.com/pusher/crank/src/api"
 )
 
-type ProcessConfig struct {
-	Cwd          string        `json:"cwd"`
-	Command      []string      `json:"command"`
-	StartTimeout time.Duration `json:"start_timeout"`
-	StopTimeout  time.Duration `json:"stop_timeout"`
-}
+// Adds the validation and persistence of the config to api.ProcessConfig
+type ProcessConfig api.ProcessConfig
 
 var DefaultConfig = &ProcessConfig{
 	Cwd:          "",
 	Command:      []string{},
-	StartTimeout: time.Second * 30,
-	StopTimeout:  time.Second * 30,
+	StartTimeout: Duration(time.Second * 30),
+	StopTimeout:  Duration(time.Second * 30),
 }
 
+// The format is chosen from the file extension. An empty file yields the
+// DefaultConfig. Unknown fields are rejected.
 func loadProcessConfig(path string) (config *ProcessConfig, err error) {
-	var reader *os.File
-	if reader, err = os.Open(path); err != nil {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
 		return
 	}
-	defer reader.Close()
+	return decodeProcessConfig(configFormatFor(path), data)
+}
 
-	config = new(ProcessConfig)
-	jsonDecoder := json.NewDecoder(reader)
-	if err = jsonDecoder.Decode(config); err != nil {
-		return DefaultConfig, err
+func decodeProcessConfig(format configFormat, data []byte) (config *ProcessConfig, err error) {
+	config = DefaultConfig.clone()
+	if len(bytes.TrimSpace(data)) == 0 {
+		return
 	}
-	if len(config.Command) == 0 {
-		return config, fmt.Errorf("Missing command")
+
+	if err = format.decode(data, config); err != nil {
+		return nil, err
 	}
 	return
 }
 
+// Writes the config in the format of the file. The comments and ordering of
+// the existing file are kept when the format allows it.
 func (self *ProcessConfig) save(path string) (err error) {
-	var writer *os.File
-	if writer, err = os.Create(path); err != nil {
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
 		return
 	}
-	defer writer.Close()
 
-	jsonEncoder := json.NewEncoder(writer)
-	return jsonEncoder.Encode(self)
+	data, err := configFormatFor(path).encode(self, original)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// Checks that the config can be used to start a process.
+func (self *ProcessConfig) validate() error {
+	if len(self.Command) == 0 {
+		return fmt.Errorf("Command is missing")
+	}
+
+	if self.Cwd != "" {
+		fi, err := os.Stat(self.Cwd)
+		if err != nil {
+			return fmt.Errorf("Invalid cwd: %s", err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("Invalid cwd: %s is not a directory", self.Cwd)
+		}
+	}
+
+	if _, err := self.lookCommand(); err != nil {
+		return fmt.Errorf("Invalid command: %s", err)
+	}
+
+	if self.StartTimeout < 0 {
+		return fmt.Errorf("Invalid start_timeout: %v", self.StartTimeout)
+	}
+	if self.StopTimeout < 0 {
+		return fmt.Errorf("Invalid stop_timeout: %v", self.StopTimeout)
+	}
+	if self.MaxExtendTimeout < 0 {
+		return fmt.Errorf("Invalid max_extend_timeout: %v", self.MaxExtendTimeout)
+	}
+	if self.Replicas < 0 {
+		return fmt.Errorf("Invalid replicas: %d", self.Replicas)
+	}
+	if self.RollingBatch < 0 {
+		return fmt.Errorf("Invalid rolling_batch: %d", self.RollingBatch)
+	}
+	if self.RollingMinReady < 0 {
+		return fmt.Errorf("Invalid rolling_min_ready: %d", self.RollingMinReady)
+	}
+
+	if err := validateHooks(self.Hooks); err != nil {
+		return err
+	}
+	if _, err := str2signal(self.standbySignal()); err != nil {
+		return fmt.Errorf("Invalid standby_signal: %s", err)
+	}
+	if _, _, err := self.restartSchedule(); err != nil {
+		return fmt.Errorf("Invalid restart_schedule: %s", err)
+	}
+	if self.MaxRSS < 0 {
+		return fmt.Errorf("Invalid max_rss: %v", self.MaxRSS)
+	}
+	if self.RestartJitter < 0 {
+		return fmt.Errorf("Invalid restart_jitter: %v", self.RestartJitter)
+	}
+	if !stringIn(self.restartQueue(), restartQueuePolicies) {
+		return fmt.Errorf("Invalid restart_queue: %q, expected one of %v", self.RestartQueue, restartQueuePolicies)
+	}
+
+	if self.Policy != nil {
+		if err := validatePolicy(self.Policy); err != nil {
+			return err
+		}
+		if err := policyAllows(self.Policy, self); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns a copy of the config where the given fields have been replaced.
+// Keys are the serialized field names and values are either JSON or a bare
+// string.
+func (self *ProcessConfig) set(values map[string]string) (config *ProcessConfig, err error) {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return
+	}
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	for key, value := range values {
+		if _, ok := configField(reflect.ValueOf(self), "json", []string{key}); !ok {
+			return nil, fmt.Errorf("Unknown config key: %s", key)
+		}
+		if json.Valid([]byte(value)) {
+			fields[key] = json.RawMessage(value)
+		} else {
+			fields[key], _ = json.Marshal(value)
+		}
+	}
+
+	if data, err = json.Marshal(fields); err != nil {
+		return
+	}
+	return decodeProcessConfig(jsonFormat{}, data)
+}
+
+func (self *ProcessConfig) replicas() int {
+	if self.Replicas <= 0 {
+		return 1
+	}
+	return self.Replicas
+}
+
+func (self *ProcessConfig) rollingBatch() int {
+	if self.RollingBatch <= 0 {
+		return 1
+	}
+	return self.RollingBatch
+}
+
+func (self *ProcessConfig) rollingMinReady() int {
+	if self.RollingMinReady <= 0 || self.RollingMinReady > self.replicas() {
+		return self.replicas()
+	}
+	return self.RollingMinReady
+}
+
+func (self *ProcessConfig) standbySignal() string {
+	if self.StandbySignal == "" {
+		return DEFAULT_STANDBY_SIGNAL
+	}
+	return self.StandbySignal
+}
+
+// Returns the path of the executable to start. A bare name is looked up in
+// the PATH, other relative paths are resolved from the process' working
+// directory.
+func (self *ProcessConfig) lookCommand() (string, error) {
+	command := self.Command[0]
+	if filepath.Base(command) != command && !filepath.IsAbs(command) {
+		command = filepath.Join(self.Cwd, command)
+	}
+	return exec.LookPath(command)
+}
+
+// Returns either the cron schedule or the maximum age of restart_schedule,
+// or neither if it's empty.
+func (self *ProcessConfig) restartSchedule() (cron *cronSchedule, maxAge time.Duration, err error) {
+	if self.RestartSchedule == "" {
+		return
+	}
+	if maxAge, err = time.ParseDuration(self.RestartSchedule); err == nil {
+		if maxAge <= 0 {
+			err = fmt.Errorf("%v is not a positive duration", maxAge)
+		}
+		return
+	}
+	cron, err = parseCronSchedule(self.RestartSchedule)
+	return
+}
+
+func (self *ProcessConfig) restartQueue() string {
+	if self.RestartQueue == "" {
+		return RESTART_QUEUE_REJECT
+	}
+	return self.RestartQueue
 }
 
 func (self *ProcessConfig) clone() *ProcessConfig {
@@ -57,5 +230,5 @@ func (self *ProcessConfig) clone() *ProcessConfig {
 }
 
 func (self *ProcessConfig) String() string {
-	return fmt.Sprintf("cwd=%s command=%v start_timeout=%v stop_timeout=%v", self.Cwd, self.Command, self.StartTimeout, self.StopTimeout)
+	return (*api.ProcessConfig)(self).String()
 }
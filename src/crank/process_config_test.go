@@ -2,10 +2,11 @@ package crank
 
 import (
 	"testing"
+	"time"
 )
 
 func TestProcessConfigCloning(t *testing.T) {
-	c := &ProcessConfig{"hello", []string{"world"}, 1, 2}
+	c := &ProcessConfig{Cwd: "hello", Command: []string{"world"}, StartTimeout: 1, StopTimeout: 2}
 
 	c2 := c.clone()
 	c2.Command = []string{"bob"}
@@ -19,3 +20,128 @@ func TestProcessConfigCloning(t *testing.T) {
 	}
 
 }
+
+func TestProcessConfigDecoding(t *testing.T) {
+	c, err := decodeProcessConfig(jsonFormat{}, []byte(`{"command": ["ls"], "start_timeout": "1m", "stop_timeout": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StartTimeout != Duration(time.Minute) {
+		t.Error("start timeout", c.StartTimeout)
+	}
+	if c.StopTimeout != Duration(5*time.Second) {
+		t.Error("stop timeout", c.StopTimeout)
+	}
+
+	// Written by older versions
+	c, err = decodeProcessConfig(jsonFormat{}, []byte(`{"command": ["ls"], "start_timeout": 30000000000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StartTimeout != Duration(30*time.Second) {
+		t.Error("legacy start timeout", c.StartTimeout)
+	}
+	if c.StopTimeout != DefaultConfig.StopTimeout {
+		t.Error("default stop timeout", c.StopTimeout)
+	}
+
+	if _, err = decodeProcessConfig(jsonFormat{}, []byte(`{"comand": ["ls"]}`)); err == nil {
+		t.Error("unknown fields should be rejected")
+	}
+
+	c, err = decodeProcessConfig(jsonFormat{}, []byte("\n"))
+	if err != nil || c.StartTimeout != DefaultConfig.StartTimeout {
+		t.Error("empty config", c, err)
+	}
+}
+
+func TestProcessConfigSet(t *testing.T) {
+	c := &ProcessConfig{Cwd: "hello", Command: []string{"world"}, StartTimeout: 1, StopTimeout: 2}
+
+	c2, err := c.set(map[string]string{"cwd": "/tmp", "command": `["ls", "-l"]`, "stop_timeout": "3s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Cwd != "/tmp" || len(c2.Command) != 2 || c2.StopTimeout != Duration(3*time.Second) {
+		t.Error(c2)
+	}
+	if c.Cwd != "hello" {
+		t.Error("original config modified", c)
+	}
+
+	if _, err = c.set(map[string]string{"foo": "bar"}); err == nil {
+		t.Error("unknown keys should be rejected")
+	}
+}
+
+func TestProcessPolicy(t *testing.T) {
+	policy := &ProcessPolicy{
+		Commands:  []string{"bin/server --port *"},
+		Cwd:       "/srv/app/releases/*",
+		Overrides: []string{"cwd"},
+	}
+	c := &ProcessConfig{
+		Cwd:     "/srv/app/releases/1",
+		Command: []string{"bin/server", "--port", "80"},
+		Policy:  policy,
+	}
+	if err := validatePolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policyAllows(policy, c); err != nil {
+		t.Error(err)
+	}
+
+	allowed := map[string]string{"cwd": "/srv/app/releases/2"}
+	if c2, err := c.set(allowed); err != nil || checkPolicy(policy, c, c2) != nil {
+		t.Error("cwd override should be allowed", err)
+	}
+
+	rejected := []map[string]string{
+		{"cwd": "/srv/app/releases/../../../etc"},
+		{"cwd": "/tmp"},
+		{"command": `["sh", "-c", "id"]`},
+		{"stop_timeout": "1s"},
+		{"policy": "null"},
+	}
+	for _, values := range rejected {
+		c2, err := c.set(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = checkPolicy(policy, c, c2); err == nil {
+			t.Error("should be rejected", values)
+		}
+	}
+
+	var nilPolicy *ProcessPolicy
+	if err := checkPolicy(nilPolicy, c, &ProcessConfig{Command: []string{"sh"}}); err != nil {
+		t.Error("nil policy", err)
+	}
+
+	if err := validatePolicy(&ProcessPolicy{Overrides: []string{"comand"}}); err == nil {
+		t.Error("unknown override should be rejected")
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	c, err := decodeProcessConfig(yamlFormat{}, []byte("command: [ls]\nrestart_schedule: 24h\nmax_rss: 512M\nrestart_jitter: 5m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxRSS != 512<<20 || c.RestartJitter != Duration(5*time.Minute) {
+		t.Error(c.MaxRSS, c.RestartJitter)
+	}
+	if cron, maxAge, err := c.restartSchedule(); err != nil || cron != nil || maxAge != 24*time.Hour {
+		t.Error(cron, maxAge, err)
+	}
+
+	c.RestartSchedule = "30 3 * * *"
+	if cron, maxAge, err := c.restartSchedule(); err != nil || cron == nil || maxAge != 0 {
+		t.Error(cron, maxAge, err)
+	}
+	c.RestartSchedule = "every night"
+	if _, _, err := c.restartSchedule(); err == nil {
+		t.Error("invalid schedules should be rejected")
+	}
+}
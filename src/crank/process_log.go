@@ -8,9 +8,9 @@ import (
 
 var EMPTY_BYTES = []byte{}
 
-func startProcessLogger(out io.Writer, prefix func() string) (w *os.File, err error) {
-	var r *os.File
-
+// Returns the end of the pipe written by the process and the one read by
+// crank
+func startProcessLogger(out io.Writer, prefix func() string) (r, w *os.File, err error) {
 	r, w, err = os.Pipe()
 	if err != nil {
 		return
@@ -18,7 +18,7 @@ func startProcessLogger(out io.Writer, prefix func() string) (w *os.File, err er
 
 	go runProcesssLogger(out, r, prefix)
 
-	return w, nil
+	return r, w, nil
 }
 
 func runProcesssLogger(out io.Writer, r *os.File, prefix func() string) {
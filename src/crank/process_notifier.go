@@ -8,33 +8,38 @@ import (
 	"syscall"
 )
 
-// TODO: The notifier can potentially have other notifications than "ready".
-//       Eg: heartbeat
+// A single KEY=VALUE assignment sent by the child on the notify socket.
+// Follows the sd_notify(3) message format.
+type notification struct {
+	key   string
+	value string
+}
 
-// Gets a channel on which to publish events.
+// Gets a channel on which to publish notifications.
 //
 // Returns a file on which the process is supposed to write data, which then
-// translate into these events.
-func startProcessNotifier(ready chan<- bool) (w *os.File, err error) {
+// translate into these notifications, and the end read by crank.
+func startProcessNotifier(notifications chan<- notification) (r, w *os.File, err error) {
 	fds, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_DGRAM, 0)
 	if err != nil {
 		return
 	}
-	r := os.NewFile(uintptr(fds[0]), "notify:r") // File name is arbitrary
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	r = os.NewFile(uintptr(fds[0]), "notify:r") // File name is arbitrary
 	w = os.NewFile(uintptr(fds[1]), "notify:w")
 
-	go runProcessNotifier(r, ready)
+	go runProcessNotifier(r, notifications)
 
-	return w, nil
+	return r, w, nil
 }
 
-func runProcessNotifier(r *os.File, ready chan<- bool) {
+func runProcessNotifier(r *os.File, notifications chan<- notification) {
 	// Read on pipe from child, and process commands
 	defer r.Close()
-	defer close(ready)
+	defer close(notifications)
 
 	var err error
-	var command string
 	var n int
 	data := make([]byte, 4096)
 
@@ -48,13 +53,18 @@ func runProcessNotifier(r *os.File, ready chan<- bool) {
 			return
 		}
 
-		command = strings.TrimSpace(string(data[:n]))
-
-		switch command {
-		case "READY=1":
-			ready <- true
-		default:
-			log.Println("Unknown command received: ", command)
+		// A datagram can contain multiple newline-separated assignments
+		for _, line := range strings.Split(string(data[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				log.Println("Unknown command received: ", line)
+				continue
+			}
+			notifications <- notification{parts[0], parts[1]}
 		}
 	}
 }
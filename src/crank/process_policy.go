@@ -0,0 +1,94 @@
+package crank
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Checks the patterns and keys of the policy
+func validatePolicy(policy *ProcessPolicy) error {
+	for _, pattern := range policy.Commands {
+		if len(strings.Fields(pattern)) == 0 {
+			return fmt.Errorf("Invalid policy command: empty pattern")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid policy command %q: %s", pattern, err)
+		}
+	}
+	if _, err := path.Match(policy.Cwd, ""); err != nil {
+		return fmt.Errorf("Invalid policy cwd %q: %s", policy.Cwd, err)
+	}
+	for _, key := range policy.Overrides {
+		if key == "policy" {
+			return fmt.Errorf("Invalid policy override: the policy can't be overridden")
+		}
+		if _, ok := configField(reflect.ValueOf(&ProcessConfig{}), "json", []string{key}); !ok {
+			return fmt.Errorf("Invalid policy override: unknown config key %s", key)
+		}
+	}
+	return nil
+}
+
+// Returns an error unless the policy allows replacing the current config by
+// the new one. A nil policy allows everything.
+func checkPolicy(policy *ProcessPolicy, current, config *ProcessConfig) error {
+	if policy == nil {
+		return nil
+	}
+
+	t := reflect.TypeOf(*config)
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if configFieldEqual(current, config, "json", []string{key}) {
+			continue
+		}
+		if key == "policy" {
+			return fmt.Errorf("Policy can only be changed in the config file")
+		}
+		if !stringIn(key, policy.Overrides) {
+			return fmt.Errorf("Policy doesn't allow overriding %s", key)
+		}
+	}
+
+	return policyAllows(policy, config)
+}
+
+// Returns an error if the command or cwd of the config don't match the
+// policy patterns
+func policyAllows(policy *ProcessPolicy, config *ProcessConfig) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.Cwd != "" {
+		// Clean avoids escaping the pattern with ..
+		if ok, _ := path.Match(policy.Cwd, filepath.Clean(config.Cwd)); !ok || config.Cwd == "" {
+			return fmt.Errorf("Policy doesn't allow cwd %q, expected %q", config.Cwd, policy.Cwd)
+		}
+	}
+
+	if len(policy.Commands) == 0 {
+		return nil
+	}
+	for _, pattern := range policy.Commands {
+		if matchCommand(strings.Fields(pattern), config.Command) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Policy doesn't allow command %q", config.Command)
+}
+
+func matchCommand(pattern []string, command []string) bool {
+	if len(pattern) != len(command) {
+		return false
+	}
+	for i := range pattern {
+		if ok, _ := path.Match(pattern[i], command[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,14 @@
 package crank
 
+import (
+	"time"
+)
+
 type processSet map[*Process]ProcessState
 
 func (set processSet) add(s *Process, state ProcessState) {
 	set[s] = state
+	s.stateSince = time.Now()
 }
 
 func (set processSet) rem(s *Process) {
@@ -20,6 +25,7 @@ func (set processSet) updateState(s *Process, state ProcessState) {
 		return
 	}
 	set[s] = state
+	s.stateSince = time.Now()
 }
 
 func (set processSet) find(state ProcessState) *Process {
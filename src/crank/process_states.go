@@ -6,6 +6,8 @@ const (
 	PROCESS_STARTING = ProcessState(1 << iota)
 	PROCESS_READY    = ProcessState(1 << iota)
 	PROCESS_STOPPING = ProcessState(1 << iota)
+	PROCESS_PAUSED   = ProcessState(1 << iota)
+	PROCESS_STANDBY  = ProcessState(1 << iota) // Ready but not promoted yet
 )
 
 func (ps ProcessState) String() string {
@@ -16,6 +18,10 @@ func (ps ProcessState) String() string {
 		return "READY"
 	case PROCESS_STOPPING:
 		return "STOPPING"
+	case PROCESS_PAUSED:
+		return "PAUSED"
+	case PROCESS_STANDBY:
+		return "STANDBY"
 	default:
 		return "BUG, unknown state"
 	}
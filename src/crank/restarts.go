@@ -0,0 +1,155 @@
+package crank
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// How often the schedule and the processes' memory are checked
+	RESTART_CHECK_INTERVAL = 10 * time.Second
+	// Number of restarts kept for crankctl history
+	RESTART_HISTORY_SIZE = 50
+	// Longest wait before checking the processes' age and memory again after
+	// failed restarts
+	RESTART_MAX_BACKOFF = time.Hour
+)
+
+// Restarts that are not requested by someone
+func automaticRestart(restart *RestartRecord) bool {
+	switch restart.Reason {
+	case RESTART_SCHEDULE, RESTART_MAX_AGE, RESTART_MAX_RSS:
+		return true
+	}
+	return false
+}
+
+func (self *Manager) recordRestart(restart *RestartRecord) {
+	self.restarts = append(self.restarts, restart)
+	if len(self.restarts) > RESTART_HISTORY_SIZE {
+		self.restarts = self.restarts[len(self.restarts)-RESTART_HISTORY_SIZE:]
+	}
+}
+
+// Time until which the processes' age and memory aren't checked because the
+// last automatic restarts failed. The delay starts at twice
+// RESTART_CHECK_INTERVAL and doubles with each consecutive failure, up to
+// RESTART_MAX_BACKOFF, counted from the start of the last failed restart.
+func (self *Manager) restartBackoff() time.Time {
+	failures := 0
+	for i := len(self.restarts) - 1; i >= 0; i-- {
+		r := self.restarts[i]
+		if !automaticRestart(r) || r.Outcome != RESTART_FAILED {
+			break
+		}
+		failures++
+	}
+	if failures == 0 {
+		return time.Time{}
+	}
+	delay := RESTART_MAX_BACKOFF
+	if failures < 16 && RESTART_CHECK_INTERVAL<<uint(failures) < delay {
+		delay = RESTART_CHECK_INTERVAL << uint(failures)
+	}
+	return self.restarts[len(self.restarts)-1].Time.Add(delay)
+}
+
+// Called every RESTART_CHECK_INTERVAL. Schedules a restart if it's time
+// according to restart_schedule or if a ready process uses more than
+// max_rss. The restart happens after a random delay up to restart_jitter.
+// Nothing happens while processes are paused, they would be replaced too.
+// After failed restarts the limits are only checked again once
+// restartBackoff has passed, the schedule waits for its next slot.
+func (self *Manager) checkRestarts(now time.Time) {
+	config := self.config
+	if self.pendingRestart != nil || self.rollout != nil || self.shuttingDown || self.childs.all(PROCESS_PAUSED).len() > 0 {
+		return
+	}
+
+	cron, maxAge, err := config.restartSchedule()
+	if err != nil {
+		return
+	}
+	if config.RestartSchedule != self.scheduledFor {
+		self.scheduledFor = config.RestartSchedule
+		self.nextScheduledRestart = time.Time{}
+		if cron != nil {
+			self.nextScheduledRestart = cron.next(now)
+		}
+		if !self.nextScheduledRestart.IsZero() {
+			self.log("Next scheduled restart at %s", self.nextScheduledRestart.Format(time.RFC3339))
+		}
+	}
+
+	ready := sortProcesses(self.childs.all(PROCESS_READY).choose(func(p *Process, _ ProcessState) bool {
+		return !p.standby
+	}))
+	if len(ready) == 0 {
+		return
+	}
+
+	var restart *RestartRecord
+	if cron != nil && !self.nextScheduledRestart.IsZero() && !now.Before(self.nextScheduledRestart) {
+		restart = &RestartRecord{
+			Reason:  RESTART_SCHEDULE,
+			Message: fmt.Sprintf("Scheduled at %s", self.nextScheduledRestart.Format(time.RFC3339)),
+		}
+		self.nextScheduledRestart = cron.next(now)
+	}
+	backoff := self.restartBackoff()
+	if restart == nil && now.Before(backoff) {
+		if !backoff.Equal(self.restartBackoffUntil) {
+			self.restartBackoffUntil = backoff
+			self.log("The last restart failed, not checking the processes' age and memory before %s", backoff.Format(time.RFC3339))
+		}
+		return
+	}
+	for _, p := range ready {
+		if restart != nil {
+			break
+		}
+		if maxAge > 0 && now.Sub(p.readyAt) >= maxAge {
+			restart = &RestartRecord{
+				Reason:  RESTART_MAX_AGE,
+				Message: fmt.Sprintf("%s is older than %v", p, maxAge),
+			}
+		} else if config.MaxRSS > 0 {
+			stats, err := readProcStats(p.Pid())
+			if err == nil && int64(stats.RSS) > int64(config.MaxRSS) {
+				restart = &RestartRecord{
+					Reason:  RESTART_MAX_RSS,
+					Message: fmt.Sprintf("%s uses %v, more than %v", p, stats.RSS, config.MaxRSS),
+				}
+			}
+		}
+	}
+	if restart == nil {
+		return
+	}
+
+	var delay time.Duration
+	if config.RestartJitter > 0 {
+		delay = time.Duration(rand.Int63n(int64(config.RestartJitter)))
+	}
+	self.log("Restarting in %v: %s", delay, restart.Message)
+	self.pendingRestart = restart
+	self.pendingRestartTimer = time.After(delay)
+}
+
+// Starts the restart scheduled by checkRestarts, unless one has been started
+// in the meantime.
+func (self *Manager) startPendingRestart() {
+	restart := self.pendingRestart
+	self.pendingRestart = nil
+	self.pendingRestartTimer = nil
+
+	if self.rollout != nil || self.shuttingDown {
+		self.log("Skipping the %s restart", restart.Reason)
+		return
+	}
+
+	self.emit(&LifecycleEvent{Type: LIFECYCLE_RESTART_SCHEDULED, Generation: self.generation + 1, Message: restart.Message})
+	done := make(chan error, 1)
+	self.startRollout(self.config, restart, false, nil, done)
+}
@@ -0,0 +1,58 @@
+package crank
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	start := time.Now()
+	m := &Manager{}
+	if !m.restartBackoff().IsZero() {
+		t.Error("no backoff without restarts")
+	}
+
+	m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_MAX_AGE, Outcome: RESTART_FAILED})
+	if got := m.restartBackoff(); !got.Equal(start.Add(2 * RESTART_CHECK_INTERVAL)) {
+		t.Error("first failure", got)
+	}
+	m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_MAX_RSS, Outcome: RESTART_FAILED})
+	if got := m.restartBackoff(); !got.Equal(start.Add(4 * RESTART_CHECK_INTERVAL)) {
+		t.Error("the delay should double", got)
+	}
+	for i := 0; i < 20; i++ {
+		m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_SCHEDULE, Outcome: RESTART_FAILED})
+	}
+	if got := m.restartBackoff(); !got.Equal(start.Add(RESTART_MAX_BACKOFF)) {
+		t.Error("the delay should be capped", got)
+	}
+
+	m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_RUN, Outcome: RESTART_FAILED})
+	if !m.restartBackoff().IsZero() {
+		t.Error("manual restarts don't back off")
+	}
+	m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_MAX_AGE, Outcome: RESTART_FAILED})
+	m.recordRestart(&RestartRecord{Time: start, Reason: RESTART_MAX_AGE, Outcome: RESTART_COMPLETED})
+	if !m.restartBackoff().IsZero() {
+		t.Error("a completed restart resets the backoff")
+	}
+}
+
+func TestCheckRestartsBackoff(t *testing.T) {
+	now := time.Now()
+	p := &Process{id: 1, readyAt: now.Add(-time.Hour)}
+	m := &Manager{
+		config: &ProcessConfig{RestartSchedule: "1m"},
+		childs: processSet{p: PROCESS_READY},
+	}
+	m.recordRestart(&RestartRecord{Time: now, Reason: RESTART_MAX_AGE, Outcome: RESTART_FAILED})
+
+	m.checkRestarts(now.Add(RESTART_CHECK_INTERVAL))
+	if m.pendingRestart != nil {
+		t.Error("the restart should wait after a failure")
+	}
+	m.checkRestarts(now.Add(2 * RESTART_CHECK_INTERVAL))
+	if m.pendingRestart == nil || m.pendingRestart.Reason != RESTART_MAX_AGE {
+		t.Error("the restart should be retried", m.pendingRestart)
+	}
+}
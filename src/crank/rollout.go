@@ -0,0 +1,222 @@
+package crank
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A rollout replaces the running replicas with new ones started from
+// config. It's done a few replicas at a time so that the service keeps
+// enough ready processes, see ProcessConfig.RollingBatch and
+// ProcessConfig.RollingMinReady.
+type rollout struct {
+	config     *ProcessConfig
+	generation int
+	restart    *RestartRecord
+	// Waiting for the pre_start hook
+	preparing bool
+	// Set if an RPC call waits for the outcome
+	reply *StartReply
+	done  chan<- error
+}
+
+// Starts replacing the current replicas with new ones. If wait is true, done
+// is only notified once all the new replicas are ready or one has failed.
+func (self *Manager) startRollout(config *ProcessConfig, restart *RestartRecord, wait bool, reply *StartReply, done chan<- error) {
+	restart.Time = time.Now()
+	restart.Outcome = RESTART_IN_PROGRESS
+	self.recordRestart(restart)
+
+	if err := config.validate(); err != nil {
+		self.log("Failed to start the process: %s", err)
+		restart.Outcome = RESTART_FAILED
+		restart.Error = err.Error()
+		self.emit(&LifecycleEvent{Type: LIFECYCLE_ROLLOUT_FAILED, Message: err.Error()})
+		done <- err
+		return
+	}
+
+	self.generation += 1
+	restart.Generation = self.generation
+	self.rollout = &rollout{config: config, generation: self.generation, restart: restart}
+	if restart.Message != "" {
+		self.log("Restarting, reason=%s: %s", restart.Reason, restart.Message)
+	}
+	if wait {
+		self.log("RPC waiting for the process to start")
+		self.rollout.reply = reply
+		self.rollout.done = done
+	}
+
+	if self.runHook(HOOK_PRE_START, config, nil, self.generation) {
+		// Continued by the HookEvent
+		self.rollout.preparing = true
+		if !wait {
+			done <- nil
+		}
+		return
+	}
+
+	if err := self.reconcile(); err != nil {
+		self.log("Failed to start the process: %s", err)
+		if !wait {
+			done <- err
+		}
+		return
+	}
+
+	if !wait {
+		done <- nil
+	}
+}
+
+// Drives the rollout forward. Called whenever the state of the processes
+// changes.
+func (self *Manager) reconcile() error {
+	r := self.rollout
+	if r == nil || r.preparing || self.shuttingDown {
+		return nil
+	}
+
+	replicas := r.config.replicas()
+	isNew := func(p *Process, _ ProcessState) bool { return p.generation == r.generation }
+	isOld := func(p *Process, _ ProcessState) bool { return p.generation != r.generation && !p.standby }
+	newSet := self.childs.choose(isNew)
+	newStarting := newSet.all(PROCESS_STARTING).len()
+	newReady := newSet.all(PROCESS_READY).len()
+
+	// Start the new replicas, a batch at a time
+	for newStarting < r.config.rollingBatch() && newStarting+newReady < replicas {
+		if p := self.standbyFor(r.config); p != nil {
+			self.promote(p, r.config, r.generation)
+			newReady++
+			continue
+		}
+		if err := self.startProcess(r.config, r.generation, false); err != nil {
+			self.abortRollout(0, err)
+			return err
+		}
+		newStarting++
+	}
+
+	// Stop the old replicas as long as enough are ready. Paused ones are
+	// replaced too.
+	oldReady := sortProcesses(self.childs.choose(isOld).all(PROCESS_READY | PROCESS_PAUSED))
+	minReady := r.config.rollingMinReady()
+	for len(oldReady) > 0 && newReady+len(oldReady)-1 >= minReady {
+		self.plog(oldReady[0], "Shutting down old replica")
+		self.stopProcess(oldReady[0])
+		oldReady = oldReady[1:]
+	}
+
+	if newReady >= replicas && len(oldReady) == 0 && newStarting == 0 {
+		self.completeRollout()
+	}
+	return nil
+}
+
+func (self *Manager) completeRollout() {
+	r := self.rollout
+	self.rollout = nil
+
+	self.log("All %d replicas are ready", r.config.replicas())
+	r.restart.Outcome = RESTART_COMPLETED
+	self.emit(&LifecycleEvent{Type: LIFECYCLE_ROLLOUT_COMPLETED, Generation: r.generation, Message: r.restart.Reason})
+
+	keep := self.configHistory
+	if automaticRestart(r.restart) {
+		// Same config, it shouldn't push the older versions out
+		keep = 0
+	}
+
+	self.config = r.config
+	self.saveConfig(keep)
+
+	if r.done != nil {
+		r.done <- nil
+	}
+
+	self.standbyFailed = false
+	self.refreshStandby()
+}
+
+// Saves self.config and a version of it, removing the versions exceeding
+// keep
+func (self *Manager) saveConfig(keep int) {
+	if err := self.config.save(self.configPath); err != nil {
+		self.log("Failed saving the config: %s", err)
+	} else if version, err := saveConfigVersion(self.configPath, keep); err != nil {
+		self.log("Failed saving the config version: %s", err)
+	} else if version > 0 {
+		self.log("Saved config version %d", version)
+	}
+}
+
+// Stops the replicas that are still starting and reports the failure. The
+// new replicas that are already ready are left running.
+func (self *Manager) abortRollout(code int, err error) {
+	r := self.rollout
+	if r == nil {
+		return
+	}
+	self.rollout = nil
+
+	self.log("Aborting the rollout: code=%d err=%v", code, err)
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	r.restart.Outcome = RESTART_FAILED
+	r.restart.Error = message
+	if code > 0 {
+		r.restart.Error = fmt.Sprintf("Exited with code %d", code)
+	}
+	self.emit(&LifecycleEvent{Type: LIFECYCLE_ROLLOUT_FAILED, Generation: r.generation, Code: code, Message: message})
+	self.childs.all(PROCESS_STARTING).each(func(p *Process) {
+		if p.generation == r.generation {
+			self.stopProcess(p)
+		}
+	})
+
+	if r.done != nil {
+		if code > 0 && err == nil {
+			// The caller gets the exit code instead
+			r.reply.Code = code
+		} else if err == nil {
+			err = fmt.Errorf("Process exited before being ready")
+		}
+		r.done <- err
+	}
+}
+
+// Changes the number of replicas outside of rollouts. Surplus replicas are
+// stopped, starting ones first.
+func (self *Manager) scale(replicas int) error {
+	running := self.childs.all(PROCESS_STARTING | PROCESS_READY | PROCESS_PAUSED).choose(func(p *Process, _ ProcessState) bool {
+		return !p.standby
+	})
+
+	for i := running.len(); i < replicas; i++ {
+		if err := self.startProcess(self.config, self.generation, false); err != nil {
+			return err
+		}
+	}
+
+	surplus := append(
+		sortProcesses(running.all(PROCESS_STARTING)),
+		sortProcesses(running.all(PROCESS_READY|PROCESS_PAUSED))...,
+	)
+	for i := 0; i < running.len()-replicas; i++ {
+		self.plog(surplus[i], "Shutting down surplus replica")
+		self.stopProcess(surplus[i])
+	}
+	return nil
+}
+
+// Orders processes by id, oldest first
+func sortProcesses(set processSet) []*Process {
+	ary := set.toSlice()
+	sort.Slice(ary, func(i, j int) bool { return ary[i].id < ary[j].id })
+	return ary
+}
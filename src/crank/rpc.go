@@ -1,109 +1,427 @@
 package crank
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/rpc"
+	"sync"
+	"time"
 )
 
+// How long a TLS client of the control socket has to complete its handshake
+const RPC_HANDSHAKE_TIMEOUT = 10 * time.Second
+
 type API struct {
-	m *Manager
+	s       *Supervisor
+	auth    *AuthConfig
+	session *session
+}
+
+// RPCServer serves the API on the control socket. Each connection gets its
+// own permissions, see AuthConfig.
+type RPCServer struct {
+	s     *Supervisor
+	auth  *AuthConfig
+	conns sync.WaitGroup
 }
 
-func NewRPCServer(m *Manager) *rpc.Server {
+// Without an auth config everybody who can reach the socket has all the
+// permissions.
+func NewRPCServer(s *Supervisor, auth *AuthConfig) *RPCServer {
+	return &RPCServer{s: s, auth: auth}
+}
+
+// Accept serves the connections of the listener until it is closed
+func (self *RPCServer) Accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Print("rpc.Serve: accept:", err.Error())
+			return
+		}
+		go self.ServeConn(conn)
+	}
+}
+
+func (self *RPCServer) ServeConn(conn net.Conn) {
+	self.conns.Add(1)
+	defer self.conns.Done()
+
+	sess := newSession()
+
+	if self.auth == nil {
+		sess.permissions[PERM_ALL] = true
+	} else if unixConn, ok := conn.(*net.UnixConn); ok {
+		cred, err := readPeerCredentials(unixConn)
+		if err != nil {
+			log.Printf("[rpc] Could not read the peer credentials: %s", err)
+		} else {
+			sess.grant(self.auth.unixUsers(cred)...)
+		}
+	} else if self.auth.tlsConfig != nil {
+		tlsConn := tls.Server(conn, self.auth.tlsConfig)
+		conn.SetDeadline(time.Now().Add(RPC_HANDSHAKE_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("[rpc] TLS handshake failed with %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			sess.grant(self.auth.certUsers(certs[0].Subject.CommonName)...)
+		}
+		conn = tlsConn
+	}
+	_, sess.cleartext = conn.(*net.TCPConn)
+
 	server := rpc.NewServer()
-	api := &API{m}
-	err := server.RegisterName("crank", api)
+	err := server.RegisterName("crank", &API{self.s, self.auth, sess})
 	if err != nil {
 		panic(err) // Coding error
 	}
-	return server
+	server.ServeConn(conn)
+}
+
+// Waits up to timeout for the clients to close their connections. Used on
+// exit so that the replies of a shutdown get delivered.
+func (self *RPCServer) Wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		self.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("[rpc] Some clients are still connected, exiting anyway")
+	}
+}
+
+// Returns an error unless the connection has the permission
+func (self *API) authorize(perm string) error {
+	if self.session.allowed(perm) {
+		return nil
+	}
+	log.Printf("[rpc] Denied %s to %s", perm, self.session)
+	return fmt.Errorf("Permission denied: %s needs the %q permission", self.session, perm)
+}
+
+// Sends the action to the manager of the app and waits for its reply
+func (self *API) send(app string, newAction func(done chan<- error) Action) error {
+	m, err := self.s.manager(app)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1) // Make the reply async
+	if !m.SendAction(newAction(done)) {
+		return errors.New(ERR_STOPPED)
+	}
+	return <-done
 }
 
-// Used by other query structs
-type ProcessQuery struct {
-	Starting bool
-	Ready    bool
-	Stopping bool
-	Pid      int
+// AUTHENTICATE
+
+// Grants the permissions of the user owning the token to the connection
+func (self *API) Authenticate(query *AuthQuery, reply *AuthReply) error {
+	if self.auth == nil {
+		reply.Permissions = []string{PERM_ALL}
+		return nil
+	}
+	if self.session.cleartext {
+		log.Printf("[rpc] Refused a token over cleartext TCP from %s", self.session)
+		return fmt.Errorf("Tokens are only accepted over TLS or a unix socket")
+	}
+	user := self.auth.tokenUser(query.Token)
+	if user == nil {
+		log.Printf("[rpc] Invalid token from %s", self.session)
+		return fmt.Errorf("Invalid token")
+	}
+	self.session.grant(user)
+	reply.Name = user.Name
+	reply.Permissions = user.Permissions
+	return nil
+}
+
+// Returns the states selected by the query, 0 if none
+func queryStates(query *ProcessQuery) (states ProcessState) {
+	if query.Starting {
+		states |= PROCESS_STARTING
+	}
+	if query.Ready {
+		states |= PROCESS_READY
+	}
+	if query.Stopping {
+		states |= PROCESS_STOPPING
+	}
+	if query.Paused {
+		states |= PROCESS_PAUSED
+	}
+	return
 }
 
 type processFilter func(*Process) *Process
 
 // START
 
-type StartQuery struct {
-	Command      []string
-	Cwd          string
-	StartTimeout int
-	StopTimeout  int
-	Wait         bool
-	Pid          int
+func (self *API) Run(query *StartQuery, reply *StartReply) error {
+	if err := self.authorize(PERM_RUN); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &StartAction{query, reply, done}
+	})
 }
 
-type StartReply struct {
-	Code int
+// ROLLBACK
+
+func (self *API) Rollback(query *RollbackQuery, reply *StartReply) error {
+	if err := self.authorize(PERM_ROLLBACK); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &RollbackAction{query, reply, done}
+	})
 }
 
-func (self *API) Run(query *StartQuery, reply *StartReply) error {
-	done := make(chan error, 1)
-	self.m.actions <- &StartAction{query, reply, done}
-	return <-done
+// SCALE
+
+func (self *API) Scale(query *ScaleQuery, reply *ScaleReply) error {
+	if err := self.authorize(PERM_SCALE); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ScaleAction{query, reply, done}
+	})
 }
 
-// INFO
+func (self *API) ConfigVersions(query *ConfigVersionsQuery, reply *ConfigVersionsReply) error {
+	if err := self.authorize(PERM_CONFIG_GET); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ConfigVersionsAction{query, reply, done}
+	})
+}
 
-type InfoQuery struct{}
+// HISTORY
 
-type InfoReply struct {
-	Info *Info
+func (self *API) History(query *HistoryQuery, reply *HistoryReply) error {
+	if err := self.authorize(PERM_PS); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &HistoryAction{query, reply, done}
+	})
 }
 
+// INFO
+
 func (self *API) Info(query *InfoQuery, reply *InfoReply) error {
-	done := make(chan error, 1)
-	self.m.actions <- &InfoAction{query, reply, done}
-	return <-done
+	if err := self.authorize(PERM_INFO); err != nil {
+		return err
+	}
+	reply.Info = GetInfo(self.s.build)
+	return nil
+}
+
+// APPS
+
+func (self *API) Apps(query *AppsQuery, reply *AppsReply) error {
+	if err := self.authorize(PERM_INFO); err != nil {
+		return err
+	}
+	for _, name := range self.s.names() {
+		app := self.s.apps[name]
+		info := &AppInfo{Name: name, Bind: app.bind, Conf: app.manager.configPath}
+
+		var ps PsReply
+		err := self.send(name, func(done chan<- error) Action {
+			return &PsAction{&PsQuery{}, &ps, done}
+		})
+		if err != nil {
+			return err
+		}
+		for _, pi := range ps.PS {
+			switch pi.State {
+			case PROCESS_STARTING.String():
+				info.Starting++
+			case PROCESS_READY.String():
+				info.Ready++
+			case PROCESS_STOPPING.String():
+				info.Stopping++
+			case PROCESS_PAUSED.String():
+				info.Paused++
+			}
+		}
+
+		reply.Apps = append(reply.Apps, info)
+	}
+	return nil
 }
 
 // PS
 
-type PsQuery struct {
-	ProcessQuery
+func newProcessInfo(p *Process, state ProcessState, timeLeft time.Duration) *ProcessInfo {
+	now := time.Now()
+	pi := &ProcessInfo{
+		Pid:           p.Pid(),
+		Cid:           p.id,
+		Generation:    p.generation,
+		State:         state.String(),
+		Cwd:           p.config.Cwd,
+		Command:       p.config.Command,
+		StartTime:     p.startedAt,
+		ReadyTime:     p.readyAt,
+		StateTime:     p.stateSince,
+		Uptime:        now.Sub(p.startedAt),
+		StateDuration: now.Sub(p.stateSince),
+		Status:        p.status,
+		TimeLeft:      timeLeft,
+	}
+	// Best effort, the process might be gone already
+	if stats, err := readProcStats(p.Pid()); err == nil {
+		pi.RSS = stats.RSS
+		pi.CPUTime = stats.CPUTime
+	}
+	return pi
 }
 
-type PsReply struct {
-	PS []*ProcessInfo
+func (self *API) Ps(query *PsQuery, reply *PsReply) error {
+	if err := self.authorize(PERM_PS); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &PsAction{query, reply, done}
+	})
 }
 
-type ProcessInfo struct {
-	Pid     int
-	Cid     int
-	State   string
-	Cwd     string
-	Command []string
+// KILL
+
+func (self *API) Kill(query *KillQuery, reply *KillReply) (err error) {
+	if err := self.authorize(PERM_KILL); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &KillAction{query, reply, done}
+	})
 }
 
-func (pi *ProcessInfo) String() string {
-	return fmt.Sprintf("%d %d %s %#v %v", pi.Pid, pi.Cid, pi.State, pi.Cwd, pi.Command)
+// PAUSE
+
+func (self *API) Pause(query *PauseQuery, reply *PauseReply) error {
+	if err := self.authorize(PERM_PAUSE); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &PauseAction{query, reply, done}
+	})
 }
 
-func (self *API) Ps(query *PsQuery, reply *PsReply) error {
-	done := make(chan error, 1) // Make the reply async
-	self.m.actions <- &PsAction{query, reply, done}
-	return <-done
+func (self *API) Resume(query *PauseQuery, reply *PauseReply) error {
+	if err := self.authorize(PERM_PAUSE); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ResumeAction{query, reply, done}
+	})
 }
 
-// KILL
+// CONFIG
 
-type KillQuery struct {
-	ProcessQuery
-	Signal string
-	Wait   bool
+func (self *API) ConfigGet(query *ConfigGetQuery, reply *ConfigReply) error {
+	if err := self.authorize(PERM_CONFIG_GET); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ConfigGetAction{query, reply, done}
+	})
 }
 
-type KillReply struct{}
+func (self *API) ConfigSet(query *ConfigSetQuery, reply *ConfigReply) error {
+	if err := self.authorize(PERM_CONFIG_SET); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ConfigSetAction{query, reply, done}
+	})
+}
 
-func (self *API) Kill(query *KillQuery, reply *KillReply) (err error) {
-	done := make(chan error, 1)
-	self.m.actions <- &KillAction{query, reply, done}
-	return <-done
+func (self *API) ConfigValidate(query *ConfigValidateQuery, reply *ConfigValidateReply) error {
+	if err := self.authorize(PERM_CONFIG_GET); err != nil {
+		return err
+	}
+	return self.send(query.App, func(done chan<- error) Action {
+		return &ConfigValidateAction{query, reply, done}
+	})
+}
+
+// UPGRADE
+
+// Only replies if the upgrade failed, the connection is closed otherwise
+func (self *API) Upgrade(query *UpgradeQuery, reply *UpgradeReply) error {
+	if err := self.authorize(PERM_UPGRADE); err != nil {
+		return err
+	}
+	return self.s.Upgrade(query.Binary)
+}
+
+// SHUTDOWN
+
+func (self *Manager) newShutdownProcessInfo(p *Process, outcome string, code int, err error) *ShutdownProcessInfo {
+	info := &ShutdownProcessInfo{
+		App:     self.name,
+		Pid:     p.Pid(),
+		Cid:     p.id,
+		Outcome: outcome,
+		Code:    code,
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func (self *API) Shutdown(query *ShutdownQuery, reply *ShutdownReply) error {
+	if err := self.authorize(PERM_SHUTDOWN); err != nil {
+		return err
+	}
+
+	names := []string{query.App}
+	if query.App == "" {
+		names = self.s.names()
+	}
+
+	// The managers all start shutting down before waiting on any of them
+	var dones []chan error
+	var replies []*ShutdownReply
+	for _, name := range names {
+		m, err := self.s.manager(name)
+		if err != nil {
+			return err
+		}
+		done := make(chan error, 1)
+		r := &ShutdownReply{}
+		if !m.SendAction(&ShutdownAction{query, r, done}) {
+			if query.App == "" {
+				continue
+			}
+			return errors.New(ERR_STOPPED)
+		}
+		dones = append(dones, done)
+		replies = append(replies, r)
+	}
+
+	var err error
+	for i, done := range dones {
+		if err2 := <-done; err2 != nil && err == nil {
+			err = err2
+		}
+		reply.Processes = append(reply.Processes, replies[i].Processes...)
+	}
+	return err
 }
@@ -0,0 +1,81 @@
+package crank
+
+import (
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// A warm standby is an extra process started from the current config that
+// boots and notifies READY=1 but doesn't accept connections yet. It's
+// started with CRANK_STANDBY=1 in its environment and waits for the
+// standby_signal before accepting. A restart with the same command and cwd,
+// or the exit of a ready process, promotes it at once instead of waiting for
+// a new process to boot. A new standby is then started behind it.
+const DEFAULT_STANDBY_SIGNAL = "SIGUSR2"
+
+// Returns the standby process, starting or ready, if any
+func (self *Manager) standby() *Process {
+	for p := range self.childs {
+		if p.standby {
+			return p
+		}
+	}
+	return nil
+}
+
+// Starts a standby if the config asks for one and there is none. Standbys
+// that fail to start are only retried after the next successful restart.
+func (self *Manager) ensureStandby() {
+	if !self.config.Standby || self.standbyFailed || self.shuttingDown || self.rollout != nil || self.standby() != nil {
+		return
+	}
+	self.log("Starting a standby process")
+	if err := self.startProcess(self.config, self.generation, true); err != nil {
+		self.log("Failed to start the standby process: %s", err)
+		self.standbyFailed = true
+	}
+}
+
+// Replaces the standby if it doesn't match the current config anymore
+func (self *Manager) refreshStandby() {
+	p := self.standby()
+	if p != nil && (!self.config.Standby || !sameProcess(p.config, self.config)) {
+		self.plog(p, "Stopping the outdated standby process")
+		p.standby = false
+		self.stopProcess(p)
+	}
+	self.ensureStandby()
+}
+
+// Returns the ready standby if it runs the same process as the config
+func (self *Manager) standbyFor(config *ProcessConfig) *Process {
+	p := self.standby()
+	if p == nil || self.childs[p] != PROCESS_STANDBY || !sameProcess(p.config, config) {
+		return nil
+	}
+	return p
+}
+
+// Turns the standby into a ready process of the generation
+func (self *Manager) promote(p *Process, config *ProcessConfig, generation int) {
+	sig, err := str2signal(config.standbySignal())
+	if err != nil {
+		sig = syscall.SIGUSR2
+	}
+	self.plog(p, "Promoting the standby process")
+	p.Signal(sig)
+
+	p.standby = false
+	p.config = config
+	p.generation = generation
+	p.readyAt = time.Now()
+	self.childs.updateState(p, PROCESS_READY)
+	self.emitProcess(LIFECYCLE_PROCESS_READY, p, 0, "")
+	self.runHook(HOOK_POST_READY, p.config, p, p.generation)
+}
+
+// True if both configs run the same command in the same directory
+func sameProcess(a, b *ProcessConfig) bool {
+	return a.Cwd == b.Cwd && reflect.DeepEqual(a.Command, b.Command)
+}
@@ -0,0 +1,34 @@
+package crank
+
+import (
+	"testing"
+)
+
+func TestSameProcess(t *testing.T) {
+	a := &ProcessConfig{Command: []string{"bin/server", "-p", "80"}, Cwd: "/srv/app"}
+	b := a.clone()
+	b.StopTimeout = Duration(1)
+	if !sameProcess(a, b) {
+		t.Error("only the command and cwd matter")
+	}
+	b.Command = []string{"bin/server", "-p", "81"}
+	if sameProcess(a, b) {
+		t.Error("different commands")
+	}
+	b = a.clone()
+	b.Cwd = "/srv/other"
+	if sameProcess(a, b) {
+		t.Error("different cwds")
+	}
+}
+
+func TestStandbySignal(t *testing.T) {
+	c := &ProcessConfig{Command: []string{"ls"}, Standby: true}
+	if c.standbySignal() != DEFAULT_STANDBY_SIGNAL {
+		t.Error(c.standbySignal())
+	}
+	c.StandbySignal = "SIGNOPE"
+	if err := c.validate(); err == nil {
+		t.Error("invalid signals should be rejected")
+	}
+}
@@ -0,0 +1,90 @@
+package crank
+
+import (
+	"fmt"
+)
+
+// What happens to crankctl run and rollback while a new process is already
+// being started, see ProcessConfig.RestartQueue
+const (
+	RESTART_QUEUE_REJECT   = "reject"   // fails with an error
+	RESTART_QUEUE_QUEUE    = "queue"    // runs after the current start, in order
+	RESTART_QUEUE_COALESCE = "coalesce" // cancels the current start for the newest request
+)
+
+var restartQueuePolicies = []string{RESTART_QUEUE_REJECT, RESTART_QUEUE_QUEUE, RESTART_QUEUE_COALESCE}
+
+// Keeps a StartAction or RollbackAction for later if a new process is
+// already being started and the policy allows it. Returns false if the
+// action should be handled right away, which coalesce makes possible by
+// cancelling the current start.
+func (self *Manager) queueStart(action Action) bool {
+	if self.rollout == nil || self.shuttingDown {
+		return false
+	}
+
+	switch self.config.restartQueue() {
+	case RESTART_QUEUE_QUEUE:
+		self.log("New process is already being started, queueing the request")
+		self.startQueue = append(self.startQueue, action)
+		return true
+	case RESTART_QUEUE_COALESCE:
+		self.log("New process is already being started, cancelling it for the new request")
+		err := fmt.Errorf("Superseded by a newer request")
+		self.rejectQueued(err)
+		self.cancelRollout(err)
+	}
+	return false
+}
+
+// Handles the next queued request once the current start is over. Called
+// before each iteration of the event loop.
+func (self *Manager) startQueued() {
+	if self.rollout != nil || len(self.startQueue) == 0 {
+		return
+	}
+
+	a := self.startQueue[0]
+	self.startQueue = self.startQueue[1:]
+	self.log("Handling the queued request, %d left", len(self.startQueue))
+	switch action := a.(type) {
+	case *StartAction:
+		self.start(action)
+	case *RollbackAction:
+		self.rollback(action)
+	}
+}
+
+// Fails all the queued requests
+func (self *Manager) rejectQueued(err error) {
+	for _, a := range self.startQueue {
+		switch action := a.(type) {
+		case *StartAction:
+			action.done <- err
+		case *RollbackAction:
+			action.done <- err
+		}
+	}
+	self.startQueue = nil
+}
+
+// Handles crankctl run -cancel and coalesced requests. The starting
+// processes of the rollout are killed, the ones already ready are left
+// running like when a start fails. The reason is the error of the RPC
+// waiting for the rollout.
+func (self *Manager) cancelRollout(reason error) error {
+	r := self.rollout
+	if r == nil {
+		return fmt.Errorf("No process is being started")
+	}
+
+	self.log("Cancelling the start of generation %d", r.generation)
+	self.childs.all(PROCESS_STARTING).each(func(p *Process) {
+		if p.generation == r.generation {
+			self.plog(p, "Killing, the start was cancelled")
+			self.killProcess(p)
+		}
+	})
+	self.abortRollout(0, reason)
+	return nil
+}
@@ -0,0 +1,54 @@
+package crank
+
+import (
+	"testing"
+)
+
+func TestQueueStart(t *testing.T) {
+	m := &Manager{config: &ProcessConfig{}, rollout: &rollout{}}
+	newAction := func() (*StartAction, chan error) {
+		done := make(chan error, 1)
+		return &StartAction{&StartQuery{}, &StartReply{}, done}, done
+	}
+
+	a1, _ := newAction()
+	if m.queueStart(a1) {
+		t.Error("rejected by default")
+	}
+
+	m.config.RestartQueue = RESTART_QUEUE_QUEUE
+	a2, done2 := newAction()
+	a3, _ := newAction()
+	if !m.queueStart(a2) || !m.queueStart(a3) || len(m.startQueue) != 2 {
+		t.Error("both requests should be queued", m.startQueue)
+	}
+
+	m.config.RestartQueue = RESTART_QUEUE_COALESCE
+	waiting := make(chan error, 1)
+	m.rollout = &rollout{restart: &RestartRecord{}, reply: &StartReply{}, done: waiting}
+	a4, _ := newAction()
+	if m.queueStart(a4) || len(m.startQueue) != 0 || m.rollout != nil {
+		t.Error("the current start should be cancelled for the newest request", m.startQueue)
+	}
+	if err := <-done2; err == nil {
+		t.Error("superseded requests should fail")
+	}
+	if err := <-waiting; err == nil {
+		t.Error("the cancelled start should fail")
+	}
+
+	m.rollout = nil
+	a5, _ := newAction()
+	if m.queueStart(a5) {
+		t.Error("nothing to wait for")
+	}
+
+	m.config.Command = []string{"ls"}
+	if err := m.config.validate(); err != nil {
+		t.Error(err)
+	}
+	m.config.RestartQueue = "later"
+	if err := m.config.validate(); err == nil {
+		t.Error("unknown policies should be rejected")
+	}
+}
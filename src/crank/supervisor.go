@@ -0,0 +1,134 @@
+package crank
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Supervisor runs the managers of all the apps handled by a crank daemon.
+type Supervisor struct {
+	build string
+	apps  map[string]*supervisedApp
+
+	// See EnableUpgrade
+	ctl          net.Listener
+	upgradeEnv   []string
+	upgradeErr   error
+	upgradeMutex sync.Mutex
+}
+
+type supervisedApp struct {
+	bind    string
+	manager *Manager
+}
+
+func NewSupervisor(build string) *Supervisor {
+	return &Supervisor{
+		build: build,
+		apps:  make(map[string]*supervisedApp),
+	}
+}
+
+// Registers an app. Must be called before Run.
+func (self *Supervisor) Add(name string, bind string, manager *Manager) {
+	self.apps[name] = &supervisedApp{bind, manager}
+}
+
+// Run starts all the managers and blocks until they have all exited.
+func (self *Supervisor) Run() {
+	var wg sync.WaitGroup
+	for _, app := range self.apps {
+		wg.Add(1)
+		go func(m *Manager) {
+			defer wg.Done()
+			m.Run()
+		}(app.manager)
+	}
+	wg.Wait()
+}
+
+// Whether one of the managers exited on the third shutdown request, in which
+// case crank should exit at once too. Only valid once Run has returned.
+func (self *Supervisor) ForcedExit() bool {
+	for _, app := range self.apps {
+		if app.manager.ForcedExit() {
+			return true
+		}
+	}
+	return false
+}
+
+// Registers an observer on all the managers. Must be called before Run.
+func (self *Supervisor) Observe(observer LifecycleObserver) {
+	for _, app := range self.apps {
+		app.manager.Observe(observer)
+	}
+}
+
+func (self *Supervisor) Reload() {
+	for _, app := range self.apps {
+		go app.manager.Reload()
+	}
+}
+
+func (self *Supervisor) Shutdown() {
+	for _, app := range self.apps {
+		app.manager.Shutdown()
+	}
+}
+
+// Checks that the event loop of every manager responds in time
+func (self *Supervisor) Ping(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for name, app := range self.apps {
+		done := make(chan error, 1)
+		go func(m *Manager) {
+			if !m.SendAction(&PsAction{&PsQuery{}, &PsReply{}, done}) {
+				// Stopped managers have nothing to answer for
+				done <- nil
+			}
+		}(app.manager)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-timer.C:
+			return fmt.Errorf("Manager of %q is not responding", name)
+		}
+	}
+	return nil
+}
+
+// Finds the manager of an app. The name can be omitted if there is only
+// one app.
+func (self *Supervisor) manager(name string) (*Manager, error) {
+	if name == "" && len(self.apps) == 1 {
+		for _, app := range self.apps {
+			return app.manager, nil
+		}
+	}
+	app, ok := self.apps[name]
+	if !ok {
+		if name == "" {
+			return nil, fmt.Errorf("Multiple apps are running, please specify one")
+		}
+		return nil, fmt.Errorf("Unknown app %s", name)
+	}
+	return app.manager, nil
+}
+
+func (self *Supervisor) names() []string {
+	names := make([]string, 0, len(self.apps))
+	for name := range self.apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,114 @@
+package crank
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SystemdNotifier reports crank's own state to systemd so that crank can run
+// as a Type=notify service, see sd_notify(3).
+type SystemdNotifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration
+	ready    sync.Once
+	env      []string
+}
+
+// Returns nil if crank wasn't started with NOTIFY_SOCKET. The NOTIFY_SOCKET
+// and WATCHDOG_* variables are removed from the environment so that the
+// processes don't talk to systemd in crank's name.
+func NewSystemdNotifier() (*SystemdNotifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	watchdogUsec := os.Getenv("WATCHDOG_USEC")
+	watchdogPid := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	if path == "" {
+		return nil, nil
+	}
+	env := []string{"NOTIFY_SOCKET=" + path}
+	if watchdogUsec != "" {
+		env = append(env, "WATCHDOG_USEC="+watchdogUsec)
+	}
+	if watchdogPid != "" {
+		env = append(env, "WATCHDOG_PID="+watchdogPid)
+	}
+
+	if path[0] == '@' {
+		// Abstract namespace
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	self := &SystemdNotifier{conn: conn, env: env}
+
+	if watchdogUsec != "" && (watchdogPid == "" || watchdogPid == strconv.Itoa(os.Getpid())) {
+		usec, err := strconv.ParseInt(watchdogUsec, 10, 64)
+		if err != nil || usec <= 0 {
+			conn.Close()
+			return nil, fmt.Errorf("Invalid WATCHDOG_USEC=%s", watchdogUsec)
+		}
+		self.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return self, nil
+}
+
+// Returns the systemd variables crank was started with, to pass them on to a
+// new crank on upgrade
+func (self *SystemdNotifier) Environ() []string {
+	if self == nil {
+		return nil
+	}
+	return self.env
+}
+
+// Sends newline-separated KEY=VALUE assignments
+func (self *SystemdNotifier) Notify(state string) error {
+	_, err := self.conn.Write([]byte(state))
+	return err
+}
+
+// Used as a LifecycleObserver. crank is ready as soon as any process is.
+func (self *SystemdNotifier) Observe(event *LifecycleEvent) {
+	var err error
+	switch event.Type {
+	case LIFECYCLE_PROCESS_READY:
+		self.ready.Do(func() {
+			err = self.Notify(fmt.Sprintf("READY=1\nSTATUS=Process %d is ready", event.Pid))
+		})
+	case LIFECYCLE_SHUTDOWN:
+		err = self.Notify("STOPPING=1\nSTATUS=Shutting down")
+	}
+	if err != nil {
+		log.Printf("[systemd] Notification failed: %s", err)
+	}
+}
+
+// Pings the systemd watchdog as long as alive returns no error. Returns at
+// once if the watchdog isn't enabled.
+func (self *SystemdNotifier) Watchdog(alive func(timeout time.Duration) error) {
+	if self.watchdog == 0 {
+		return
+	}
+	// Ping twice per period, as recommended
+	interval := self.watchdog / 2
+	for range time.Tick(interval) {
+		if err := alive(interval); err != nil {
+			log.Printf("[systemd] Skipping the watchdog ping: %s", err)
+			continue
+		}
+		if err := self.Notify("WATCHDOG=1"); err != nil {
+			log.Printf("[systemd] Notification failed: %s", err)
+		}
+	}
+}
@@ -1,25 +1,45 @@
 package crank
 
 import (
+	"container/heap"
 	"sync"
 	"time"
 )
 
+// TimeoutTracker sends the processes whose deadline has passed on
+// timeoutNotification. The deadlines are kept in a min-heap with a single
+// timer set for the earliest one.
+//
+// The mutex only guards the heap and is never held while sending, so the
+// receiver can call Add or Remove at any time. A notification can thus
+// arrive right after its process was removed and receivers need to check
+// that it still applies.
 type TimeoutTracker struct {
-	timeouts            map[*Process]time.Time
-	ticker              *time.Ticker
+	clock               Clock
+	timeouts            timeoutHeap
+	byProcess           map[*Process]*timeout
+	expired             map[*Process]bool // and not removed since, see Suspend
 	timeoutNotification chan *Process
-	stopAction          chan bool
-	mutex               *sync.Mutex
+	wake                chan struct{} // the earliest deadline has changed
+	stop                chan struct{}
+	stopOnce            sync.Once
+	mutex               sync.Mutex
+}
+
+type timeout struct {
+	process  *Process
+	deadline time.Time
+	index    int // in the heap
 }
 
 func NewTimeoutTracker() *TimeoutTracker {
 	return &TimeoutTracker{
-		timeouts:            make(map[*Process]time.Time),
-		ticker:              time.NewTicker(100 * time.Millisecond),
+		clock:               realClock{},
+		byProcess:           make(map[*Process]*timeout),
+		expired:             make(map[*Process]bool),
 		timeoutNotification: make(chan *Process),
-		stopAction:          make(chan bool),
-		mutex:               &sync.Mutex{},
+		wake:                make(chan struct{}, 1),
+		stop:                make(chan struct{}),
 	}
 }
 
@@ -27,40 +47,179 @@ func (self *TimeoutTracker) Add(p *Process, timeout time.Duration) {
 	if timeout <= 0 {
 		return
 	}
-	self.mutex.Lock()
-	self.timeouts[p] = time.Now().Add(timeout)
-	self.mutex.Unlock()
+	self.set(p, self.clock.Now().Add(timeout))
 }
 
 func (self *TimeoutTracker) Remove(p *Process) {
 	self.mutex.Lock()
-	delete(self.timeouts, p)
+	self.remove(p)
 	self.mutex.Unlock()
 }
 
+// Pushes back the deadline of the process, if it's tracked and the new one
+// is later. Returns false if it isn't tracked.
+func (self *TimeoutTracker) Extend(p *Process, deadline time.Time) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	t, ok := self.byProcess[p]
+	if !ok {
+		return false
+	}
+	// Run finds out on its next wake up, the timer can only be early
+	if deadline.After(t.deadline) {
+		t.deadline = deadline
+		heap.Fix(&self.timeouts, t.index)
+	}
+	return true
+}
+
+// Returns when the process times out, or false if it isn't tracked
+func (self *TimeoutTracker) Deadline(p *Process) (time.Time, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if t, ok := self.byProcess[p]; ok {
+		return t.deadline, true
+	}
+	return time.Time{}, false
+}
+
+// Removes the process and returns the time it had left, or false if it
+// wasn't tracked. A process that expired but wasn't removed since has 1ms
+// left: its notification can be ignored by a receiver that sees it paused,
+// so it times out again once added back.
+func (self *TimeoutTracker) Suspend(p *Process) (time.Duration, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.expired[p] {
+		delete(self.expired, p)
+		return time.Millisecond, true
+	}
+	t, ok := self.remove(p)
+	if !ok {
+		return 0, false
+	}
+	left := t.deadline.Sub(self.clock.Now())
+	if left <= 0 {
+		left = time.Millisecond
+	}
+	return left, true
+}
+
+// Sends the notifications until Stop is called
 func (self *TimeoutTracker) Run() {
+	timer := self.clock.NewTimer(0)
+	defer timer.Stop()
+
 	for {
+		expired, next := self.expire(self.clock.Now())
+		for _, p := range expired {
+			select {
+			case self.timeoutNotification <- p:
+			case <-self.stop:
+				return
+			}
+		}
+		if len(expired) > 0 {
+			// More might have expired while sending
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(next)
+		}
+
 		select {
-		case t := <-self.ticker.C:
-			self.expireOld(t)
-		case <-self.stopAction:
-			self.ticker.Stop()
+		case <-timer.C():
+		case <-self.wake:
+		case <-self.stop:
 			return
 		}
 	}
 }
 
+// Makes Run return. Can be called more than once, and before Run.
 func (self *TimeoutTracker) Stop() {
-	self.stopAction <- true
+	self.stopOnce.Do(func() {
+		close(self.stop)
+	})
 }
 
-func (self *TimeoutTracker) expireOld(now time.Time) {
+func (self *TimeoutTracker) set(p *Process, deadline time.Time) {
 	self.mutex.Lock()
-	for p, timeout := range self.timeouts {
-		if timeout.Before(now) {
-			delete(self.timeouts, p)
-			self.timeoutNotification <- p
-		}
+	delete(self.expired, p)
+	if t, ok := self.byProcess[p]; ok {
+		t.deadline = deadline
+		heap.Fix(&self.timeouts, t.index)
+	} else {
+		t = &timeout{process: p, deadline: deadline}
+		heap.Push(&self.timeouts, t)
+		self.byProcess[p] = t
 	}
 	self.mutex.Unlock()
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+		// Already pending
+	}
+}
+
+// Must hold the mutex
+func (self *TimeoutTracker) remove(p *Process) (*timeout, bool) {
+	delete(self.expired, p)
+	t, ok := self.byProcess[p]
+	if ok {
+		heap.Remove(&self.timeouts, t.index)
+		delete(self.byProcess, p)
+	}
+	return t, ok
+}
+
+// Pops the processes whose deadline has passed and returns the next
+// deadline, or the zero time if there is none.
+func (self *TimeoutTracker) expire(now time.Time) (expired []*Process, next time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for len(self.timeouts) > 0 && !self.timeouts[0].deadline.After(now) {
+		t := heap.Pop(&self.timeouts).(*timeout)
+		delete(self.byProcess, t.process)
+		self.expired[t.process] = true
+		expired = append(expired, t.process)
+	}
+	if len(self.timeouts) > 0 {
+		next = self.timeouts[0].deadline
+	}
+	return
+}
+
+// A container/heap of the deadlines, earliest first
+type timeoutHeap []*timeout
+
+func (h timeoutHeap) Len() int           { return len(h) }
+func (h timeoutHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h timeoutHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timeoutHeap) Push(x interface{}) {
+	t := x.(*timeout)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timeoutHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
 }
@@ -0,0 +1,145 @@
+package crank
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutTrackerExtend(t *testing.T) {
+	tracker := NewTimeoutTracker()
+	p := &Process{}
+
+	if tracker.Extend(p, time.Now().Add(time.Hour)) {
+		t.Error("untracked processes can't be extended")
+	}
+
+	tracker.Add(p, time.Minute)
+	deadline, ok := tracker.Deadline(p)
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Error(deadline, ok)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if !tracker.Extend(p, later) {
+		t.Error("should be extended")
+	}
+	if deadline, _ = tracker.Deadline(p); !deadline.Equal(later) {
+		t.Error(deadline, later)
+	}
+
+	// Extensions never shorten the timeout
+	tracker.Extend(p, time.Now())
+	if deadline, _ = tracker.Deadline(p); !deadline.Equal(later) {
+		t.Error(deadline, later)
+	}
+
+	tracker.Remove(p)
+	if _, ok = tracker.Deadline(p); ok {
+		t.Error("should be removed")
+	}
+}
+
+func TestTimeoutTrackerRun(t *testing.T) {
+	tracker := NewTimeoutTracker()
+	go tracker.Run()
+	defer tracker.Stop()
+
+	p1, p2, p3 := &Process{id: 1}, &Process{id: 2}, &Process{id: 3}
+	start := time.Now()
+	tracker.Add(p2, 60*time.Millisecond)
+	tracker.Add(p1, 20*time.Millisecond)
+	tracker.Add(p3, 40*time.Millisecond)
+	tracker.Remove(p3)
+
+	for _, expected := range []*Process{p1, p2} {
+		select {
+		case p := <-tracker.timeoutNotification:
+			if p != expected {
+				t.Errorf("got cid=%d, expected cid=%d", p.id, expected.id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no notification")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Error("notified too early", elapsed)
+	}
+
+	// The receiver can change the deadlines while a notification is pending
+	tracker.Add(p1, time.Millisecond)
+	tracker.Add(p2, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		tracker.Remove(p2)
+		tracker.Add(p3, time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Add and Remove blocked by a pending notification")
+	}
+	// Both had expired already, p2 is notified even though it was removed
+	for i := 0; i < 2; i++ {
+		if p := <-tracker.timeoutNotification; p != p1 && p != p2 {
+			t.Errorf("unexpected cid=%d", p.id)
+		}
+	}
+
+	select {
+	case p := <-tracker.timeoutNotification:
+		t.Errorf("unexpected cid=%d", p.id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := tracker.Deadline(p3); !ok {
+		t.Error("p3 should still be tracked")
+	}
+}
+
+func TestTimeoutTrackerStop(t *testing.T) {
+	tracker := NewTimeoutTracker()
+	tracker.Stop()
+	tracker.Stop()
+
+	// Returns right away, even with a notification nobody receives
+	tracker.Add(&Process{}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		tracker.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after Stop")
+	}
+}
+
+func TestTimeoutTrackerSuspendExpired(t *testing.T) {
+	tracker := NewTimeoutTracker()
+	p := &Process{}
+
+	tracker.Add(p, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	// Popped by Run, the notification is still on its way
+	if expired, _ := tracker.expire(time.Now()); len(expired) != 1 {
+		t.Fatal("should have expired", expired)
+	}
+	left, ok := tracker.Suspend(p)
+	if !ok || left != time.Millisecond {
+		t.Errorf("the expiry should be kept for the resume, got %v %v", left, ok)
+	}
+	if _, ok = tracker.Suspend(p); ok {
+		t.Error("only reported once")
+	}
+
+	tracker.Add(p, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	tracker.expire(time.Now())
+	tracker.Remove(p)
+	if _, ok = tracker.Suspend(p); ok {
+		t.Error("removed processes aren't tracked anymore")
+	}
+}
@@ -0,0 +1,390 @@
+package crank
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Environment variable pointing a new crank to the state left by the crank
+// it replaces
+const UPGRADE_STATE_ENV = "CRANK_UPGRADE_STATE"
+
+// UpgradeState is handed over by a crank re-executing itself with a new
+// binary. The file descriptors are inherited through the exec, which keeps
+// the pid, so the processes stay children of crank.
+type UpgradeState struct {
+	Ctl  int                         `json:"ctl"`
+	Apps map[string]*appUpgradeState `json:"apps"`
+}
+
+type appUpgradeState struct {
+	Socket       int                    `json:"socket"`
+	ProcessCount int                    `json:"process_count"`
+	Generation   int                    `json:"generation"`
+	Processes    []*processUpgradeState `json:"processes"`
+	Restarts     []*RestartRecord       `json:"restarts"`
+}
+
+type processUpgradeState struct {
+	Pid        int            `json:"pid"`
+	Id         int            `json:"id"`
+	Generation int            `json:"generation"`
+	State      ProcessState   `json:"state"`
+	Config     *ProcessConfig `json:"config"`
+	StartedAt  time.Time      `json:"started_at"`
+	ReadyAt    time.Time      `json:"ready_at"`
+	StateSince time.Time      `json:"state_since"`
+	// Of the start or stop timeout, see Process.timeoutSince
+	TimeoutSince time.Time `json:"timeout_since"`
+	Status       string    `json:"status"`
+	NotifyFd     int       `json:"notify_fd"`
+	LogFd        int       `json:"log_fd"`
+	Standby      bool      `json:"standby"`
+	Deadline     time.Time `json:"deadline"` // Of the start or stop timeout
+}
+
+// Returns nil unless crank was started by an upgrade. The state file and
+// variable are removed.
+func LoadUpgradeState() (state *UpgradeState, err error) {
+	path := os.Getenv(UPGRADE_STATE_ENV)
+	if path == "" {
+		return nil, nil
+	}
+	os.Unsetenv(UPGRADE_STATE_ENV)
+	defer os.Remove(path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	state = new(UpgradeState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Returns the inherited control socket
+func (self *UpgradeState) CtlFile() *os.File {
+	if self == nil {
+		return nil
+	}
+	syscall.CloseOnExec(self.Ctl)
+	return os.NewFile(uintptr(self.Ctl), "ctl")
+}
+
+// Returns the inherited bind socket of the app, or nil
+func (self *UpgradeState) Socket(app string) *os.File {
+	if self == nil || self.Apps[app] == nil {
+		return nil
+	}
+	fd := self.Apps[app].Socket
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), "socket")
+}
+
+// Restores close-on-exec on the inherited file descriptors if the upgrade
+// failed, so that they don't leak to the processes
+func (self *UpgradeState) closeOnExec() {
+	fds := []int{self.Ctl}
+	for _, app := range self.Apps {
+		fds = append(fds, app.fds()...)
+	}
+	for _, fd := range fds {
+		if fd > 2 {
+			syscall.CloseOnExec(fd)
+		}
+	}
+}
+
+func (self *appUpgradeState) fds() []int {
+	fds := []int{self.Socket}
+	for _, p := range self.Processes {
+		fds = append(fds, p.NotifyFd, p.LogFd)
+	}
+	return fds
+}
+
+// Returns the fd of the file after making sure it survives exec
+func inheritFile(f *os.File) (fd int, err error) {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	var fcntlErr error
+	err = raw.Control(func(ufd uintptr) {
+		fd = int(ufd)
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, ufd, syscall.F_SETFD, 0)
+		if errno != 0 {
+			fcntlErr = errno
+		}
+	})
+	if err == nil {
+		err = fcntlErr
+	}
+	return
+}
+
+// Called from the event loop. Processes that are starting or a rollout in
+// progress could miss notifications during the upgrade, so they are
+// refused.
+func (self *Manager) upgradeState() (state *appUpgradeState, err error) {
+	if self.shuttingDown {
+		return nil, errors.New(ERR_SHUTTING_DOWN)
+	}
+	if self.rollout != nil {
+		return nil, errors.New(ERR_START_IN_PROGRESS)
+	}
+	if self.hooksRunning > 0 {
+		return nil, fmt.Errorf("Hooks are running, retry once they are done")
+	}
+	if self.childs.all(PROCESS_PAUSED).len() > 0 {
+		return nil, fmt.Errorf("Processes are paused, resume them first")
+	}
+	if self.childs.all(PROCESS_STARTING).len() > 0 {
+		return nil, fmt.Errorf("Processes are starting, retry once they are ready")
+	}
+
+	state = &appUpgradeState{
+		ProcessCount: self.processCount,
+		Restarts:     self.restarts,
+		Generation:   self.generation,
+	}
+	defer func() {
+		if err != nil {
+			(&UpgradeState{Apps: map[string]*appUpgradeState{"": state}}).closeOnExec()
+		}
+	}()
+
+	if state.Socket, err = inheritFile(self.socket); err != nil {
+		return
+	}
+	for p, ps := range self.childs {
+		s := &processUpgradeState{
+			Pid:          p.Pid(),
+			Id:           p.id,
+			Generation:   p.generation,
+			State:        ps,
+			Config:       p.config,
+			StartedAt:    p.startedAt,
+			ReadyAt:      p.readyAt,
+			StateSince:   p.stateSince,
+			TimeoutSince: p.timeoutSince,
+			Status:       p.status,
+			Standby:      p.standby,
+		}
+		s.Deadline, _ = self.deadline(p)
+		state.Processes = append(state.Processes, s)
+		if s.NotifyFd, err = inheritFile(p.notifyReader); err != nil {
+			return
+		}
+		if s.LogFd, err = inheritFile(p.logReader); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Adopt takes over the processes left by the previous crank. Must be called
+// before Run.
+func (self *Manager) Adopt(upgrade *UpgradeState) {
+	state := upgrade.Apps[self.name]
+	if state == nil {
+		return
+	}
+
+	self.processCount = state.ProcessCount
+	self.generation = state.Generation
+	self.restarts = state.Restarts
+
+	for _, s := range state.Processes {
+		p := adoptProcess(self.name, s, self.events)
+		self.childs.add(p, s.State)
+		p.stateSince = s.StateSince
+		p.timeoutSince = s.TimeoutSince
+		if p.timeoutSince.IsZero() {
+			// Handed over by an older crank
+			p.timeoutSince = s.StateSince
+		}
+
+		// Continue the timeouts where the previous crank left them
+		switch {
+		case s.State == PROCESS_STARTING && !s.Deadline.IsZero():
+			self.startingTracker.Add(p, untilDeadline(s.Deadline))
+		case s.State == PROCESS_STARTING:
+			self.startingTracker.Add(p, remaining(s.StartedAt, time.Duration(s.Config.StartTimeout)))
+		case s.State == PROCESS_STOPPING && !s.Deadline.IsZero():
+			self.stoppingTracker.Add(p, untilDeadline(s.Deadline))
+		case s.State == PROCESS_STOPPING:
+			self.stoppingTracker.Add(p, remaining(s.StateSince, time.Duration(s.Config.StopTimeout)))
+		}
+		self.plog(p, "Adopted %s process", s.State)
+	}
+}
+
+func adoptProcess(name string, s *processUpgradeState, events chan<- Event) *Process {
+	// Never fails on unix
+	process, _ := os.FindProcess(s.Pid)
+
+	syscall.CloseOnExec(s.NotifyFd)
+	syscall.CloseOnExec(s.LogFd)
+
+	p := &Process{
+		Process:      process,
+		id:           s.Id,
+		config:       s.Config,
+		generation:   s.Generation,
+		startedAt:    s.StartedAt,
+		readyAt:      s.ReadyAt,
+		status:       s.Status,
+		standby:      s.Standby,
+		adopted:      true,
+		notifyReader: os.NewFile(uintptr(s.NotifyFd), "notify:r"),
+		logReader:    os.NewFile(uintptr(s.LogFd), "log:r"),
+	}
+
+	prefix := func() string {
+		if name != "" {
+			return fmt.Sprintf("%s [%s] %s ", time.Now().Format(time.StampMilli), name, p.String())
+		}
+		return fmt.Sprintf("%s %s ", time.Now().Format(time.StampMilli), p.String())
+	}
+	go runProcesssLogger(os.Stdout, p.logReader, prefix)
+
+	notifications := make(chan notification)
+	go runProcessNotifier(p.notifyReader, notifications)
+	p.watch(notifications, events)
+
+	return p
+}
+
+// Time left until the timeout. Already expired timeouts fire right away.
+func remaining(since time.Time, timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	left := time.Until(since.Add(timeout))
+	if left <= 0 {
+		return time.Millisecond
+	}
+	return left
+}
+
+// Same for a deadline, possibly extended with EXTEND_TIMEOUT_USEC
+func untilDeadline(deadline time.Time) time.Duration {
+	if left := time.Until(deadline); left > 0 {
+		return left
+	}
+	return time.Millisecond
+}
+
+// Allows upgrades through the control socket. The env is added to the
+// environment of the new crank.
+func (self *Supervisor) EnableUpgrade(ctl net.Listener, env ...string) {
+	self.ctl = ctl
+	self.upgradeEnv = env
+}
+
+// Makes upgrades fail with the given reason
+func (self *Supervisor) DisableUpgrade(reason error) {
+	self.upgradeErr = reason
+}
+
+// Upgrade re-executes crank with the given binary, or the current one. The
+// managers are frozen while the state is handed over and resumed if the
+// exec fails. On success it never returns.
+func (self *Supervisor) Upgrade(binary string) (err error) {
+	self.upgradeMutex.Lock()
+	defer self.upgradeMutex.Unlock()
+
+	if self.upgradeErr != nil {
+		return self.upgradeErr
+	}
+	if self.ctl == nil {
+		return fmt.Errorf("Upgrades are not enabled")
+	}
+
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return
+		}
+	}
+	fi, err := os.Stat(binary)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", binary)
+	}
+
+	state := &UpgradeState{Apps: make(map[string]*appUpgradeState)}
+	resume := make(chan struct{})
+	defer close(resume)
+	defer func() {
+		if err != nil {
+			state.closeOnExec()
+		}
+	}()
+
+	for _, name := range self.names() {
+		appState := new(appUpgradeState)
+		done := make(chan error, 1)
+		if !self.apps[name].manager.SendAction(&UpgradeAction{appState, done, resume}) {
+			return fmt.Errorf("Manager of %s has stopped", name)
+		}
+		if err = <-done; err != nil {
+			return fmt.Errorf("Can't upgrade %s: %s", name, err)
+		}
+		state.Apps[name] = appState
+	}
+
+	ctlFile, err := self.ctl.(filer).File()
+	if err != nil {
+		return
+	}
+	// Also keeps the file from being garbage collected before the exec
+	defer ctlFile.Close()
+	if state.Ctl, err = inheritFile(ctlFile); err != nil {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile("", "crank-upgrade")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	env := append(os.Environ(), self.upgradeEnv...)
+	env = append(env, UPGRADE_STATE_ENV+"="+f.Name())
+
+	log.Printf("[supervisor] Upgrading to %s", binary)
+	err = syscall.Exec(binary, os.Args, env)
+
+	// Only reached if the exec failed
+	log.Printf("[supervisor] Upgrade failed: %s", err)
+	os.Remove(f.Name())
+	return
+}
+
+// Implemented by the listeners of the control socket
+type filer interface {
+	File() (*os.File, error)
+}
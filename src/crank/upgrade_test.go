@@ -0,0 +1,160 @@
+package crank_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pusher/crank/src/client"
+	"github.com/pusher/crank/src/crank"
+	"github.com/pusher/crank/src/cranktest"
+)
+
+// Runs a real crank since the upgrade re-executes it
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary, err := cranktest.BuildCrank(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&crank.ProcessConfig{
+		// Leaves no process behind if the test fails
+		Command:      cranktest.Child("-ignore-term", "-exit-after", "60s"),
+		StartTimeout: crank.Duration(30 * time.Second),
+		StopTimeout:  crank.Duration(2 * time.Second),
+		Replicas:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "app.json")
+	if err = ioutil.WriteFile(conf, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := os.Create(filepath.Join(dir, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	ctl := "unix://" + filepath.Join(dir, "ctl")
+	cmd := exec.Command(binary, "-bind", "tcp://127.0.0.1:0", "-conf", conf, "-ctl", ctl)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+		if t.Failed() {
+			data, _ := ioutil.ReadFile(output.Name())
+			t.Logf("crank output:\n%s", data)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cranktest.WaitTimeout)
+	defer cancel()
+	var c *client.Client
+	waitFor(t, "the control socket", func() bool {
+		c, err = client.Dial(ctx, ctl, nil)
+		return err == nil
+	})
+	defer c.Close()
+
+	ps := func() map[int]string {
+		states := make(map[int]string)
+		infos, err := c.Ps(ctx, &client.PsQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pi := range infos {
+			states[pi.Pid] = pi.State
+		}
+		return states
+	}
+	waitFor(t, "2 ready processes", func() bool {
+		n := 0
+		for _, state := range ps() {
+			if state == "READY" {
+				n++
+			}
+		}
+		return n == 2
+	})
+
+	// One replica keeps stopping until its stop timeout, which the new crank
+	// has to enforce
+	if err = c.Scale(ctx, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	var ready, stopping int
+	waitFor(t, "a stopping process", func() bool {
+		for pid, state := range ps() {
+			switch state {
+			case "READY":
+				ready = pid
+			case "STOPPING":
+				stopping = pid
+			}
+		}
+		return ready > 0 && stopping > 0
+	})
+
+	if _, err = c.Upgrade(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := ps()[ready]; state != "READY" {
+		t.Errorf("Expected pid=%d to be adopted as READY, got %q", ready, state)
+	}
+	restarts, err := c.History(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarts) != 1 || restarts[0].Reason != crank.RESTART_STARTUP {
+		t.Errorf("Expected the history to be handed over, got %v", restarts)
+	}
+	waitFor(t, "the stopping process to be killed", func() bool {
+		_, ok := ps()[stopping]
+		return !ok
+	})
+
+	if _, err = c.Shutdown(ctx, &client.ShutdownQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	// crank waits for the control connections
+	c.Close()
+	select {
+	case err = <-exited:
+		exited <- err
+		if err != nil {
+			t.Errorf("Expected the new crank to exit cleanly, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Error("Timed out waiting for crank to exit")
+	}
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(cranktest.WaitTimeout)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -2,8 +2,11 @@ package crank
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"time"
 )
@@ -64,36 +67,50 @@ func fail(v ...interface{}) (err error) {
 	return err
 }
 
-type ByteCount int64
-
-var byteExp = map[int]string{
-	0: "bytes",
-	1: "Kb",
-	2: "Mb",
-	3: "Gb",
-}
-
-func (b ByteCount) String() string {
-	var (
-		exp int
-		num float64
-	)
-	for num = float64(b); num > 1024 && exp < 4; exp++ {
-		num /= 1024
+// Replaces the file at path with data so that readers either see the old or
+// the new content, even if crank crashes in the middle.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
 	}
-	return fmt.Sprintf("%0.2f %s", num, byteExp[exp])
-}
 
-type Info struct {
-	NumGoroutine int
-	Version      string
-	Build        string
-}
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return
+	}
 
-func (info *Info) String() string {
-	return fmt.Sprintf("goroutines: %d\nversion: %s\nbuild: %s", info.NumGoroutine, info.Version, info.Build)
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func GetInfo(build string) *Info {
-	return &Info{runtime.NumGoroutine(), VERSION, build}
+	return &Info{NumGoroutine: runtime.NumGoroutine(), Version: VERSION, Build: build}
 }
@@ -0,0 +1,231 @@
+package crank
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	WEBHOOK_QUEUE_SIZE      = 100
+	DEFAULT_WEBHOOK_RETRIES = 3
+	DEFAULT_WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+// Delay before the first retry, doubled after each attempt
+var webhookRetryDelay = time.Second
+
+// Describes the HTTP endpoints notified of the lifecycle events. Like the
+// process config, the format is chosen from the file extension. Eg in YAML:
+//
+//	webhooks:
+//	  - url: https://chat.example.com/hooks/deploys
+//	    events: [rollout_failed, process_failed, process_killed]
+//	    template: '{"text": {{printf "%s: %s %s" .App .Type .Message | json}}}'
+//
+// Without events all of them are sent. Without a template the body is the
+// event as JSON.
+type WebhooksConfig struct {
+	Webhooks []*Webhook `json:"webhooks" yaml:"webhooks" toml:"webhooks"`
+}
+
+type Webhook struct {
+	URL         string            `json:"url" yaml:"url" toml:"url"`
+	Events      []string          `json:"events" yaml:"events" toml:"events"`
+	Template    string            `json:"template" yaml:"template" toml:"template"`
+	ContentType string            `json:"content_type" yaml:"content_type" toml:"content_type"`
+	Headers     map[string]string `json:"headers" yaml:"headers" toml:"headers"`
+	// Number of retries after a failed delivery. Defaults to 3, negative
+	// values disable them.
+	Retries int `json:"retries" yaml:"retries" toml:"retries"`
+	// Per request. Defaults to 10s.
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+
+	template *template.Template
+}
+
+func LoadWebhooksConfig(path string) (config *WebhooksConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	config = new(WebhooksConfig)
+	if err = configFormatFor(path).decode(data, config); err != nil {
+		return nil, err
+	}
+
+	for i, hook := range config.Webhooks {
+		if hook == nil || hook.URL == "" {
+			return nil, fmt.Errorf("Webhook at index %d needs a url", i)
+		}
+		if hook.Template != "" {
+			hook.template, err = template.New(hook.URL).Funcs(webhookFuncs).Parse(hook.Template)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid template for webhook %s: %s", hook.URL, err)
+			}
+		}
+	}
+	return
+}
+
+var webhookFuncs = template.FuncMap{
+	// Quotes a value for use in a JSON body
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func (self *Webhook) wants(event *LifecycleEvent) bool {
+	return len(self.Events) == 0 || stringIn(event.Type, self.Events)
+}
+
+func (self *Webhook) body(event *LifecycleEvent) ([]byte, error) {
+	if self.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	err := self.template.Execute(&buf, event)
+	return buf.Bytes(), err
+}
+
+func (self *Webhook) retries() int {
+	if self.Retries == 0 {
+		return DEFAULT_WEBHOOK_RETRIES
+	}
+	if self.Retries < 0 {
+		return 0
+	}
+	return self.Retries
+}
+
+// WebhookNotifier delivers the lifecycle events to the webhooks. Each
+// webhook has its own bounded queue and goroutine so that a slow endpoint
+// only delays its own notifications and never the managers. Events that
+// don't fit in the queue are dropped.
+type WebhookNotifier struct {
+	queues []*webhookQueue
+	wg     sync.WaitGroup
+}
+
+type webhookQueue struct {
+	hook   *Webhook
+	events chan *LifecycleEvent
+	client *http.Client
+}
+
+func NewWebhookNotifier(config *WebhooksConfig) *WebhookNotifier {
+	self := &WebhookNotifier{}
+	for _, hook := range config.Webhooks {
+		timeout := DEFAULT_WEBHOOK_TIMEOUT
+		if hook.Timeout > 0 {
+			timeout = time.Duration(hook.Timeout)
+		}
+		q := &webhookQueue{
+			hook:   hook,
+			events: make(chan *LifecycleEvent, WEBHOOK_QUEUE_SIZE),
+			client: &http.Client{Timeout: timeout},
+		}
+		self.queues = append(self.queues, q)
+
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+			q.run()
+		}()
+	}
+	return self
+}
+
+// A LifecycleObserver
+func (self *WebhookNotifier) Observe(event *LifecycleEvent) {
+	for _, q := range self.queues {
+		if !q.hook.wants(event) {
+			continue
+		}
+		select {
+		case q.events <- event:
+		default:
+			log.Printf("[webhook] Queue of %s is full, dropping %s", q.hook.URL, event.Type)
+		}
+	}
+}
+
+// Stops accepting events and waits up to timeout for the queued ones to be
+// delivered. Observe must not be called anymore.
+func (self *WebhookNotifier) Close(timeout time.Duration) {
+	for _, q := range self.queues {
+		close(q.events)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("[webhook] Some events were not delivered in time")
+	}
+}
+
+func (self *webhookQueue) run() {
+	for event := range self.events {
+		body, err := self.hook.body(event)
+		if err != nil {
+			log.Printf("[webhook] Could not render %s for %s: %s", event.Type, self.hook.URL, err)
+			continue
+		}
+
+		delay := webhookRetryDelay
+		for attempt := 0; ; attempt++ {
+			if err = self.post(body); err == nil {
+				break
+			}
+			if attempt >= self.hook.retries() {
+				log.Printf("[webhook] Giving up on %s for %s: %s", event.Type, self.hook.URL, err)
+				break
+			}
+			log.Printf("[webhook] Failed to send %s to %s, retrying in %v: %s", event.Type, self.hook.URL, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (self *webhookQueue) post(body []byte) error {
+	req, err := http.NewRequest("POST", self.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	contentType := self.hook.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range self.hook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return nil
+}
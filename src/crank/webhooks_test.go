@@ -0,0 +1,96 @@
+package crank
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadWebhooksConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "webhooks.yaml")
+	ioutil.WriteFile(path, []byte("webhooks:\n  - url: http://localhost/\n    template: '{{.Nope'\n"), 0644)
+	if _, err = LoadWebhooksConfig(path); err == nil {
+		t.Error("invalid templates should be rejected")
+	}
+
+	ioutil.WriteFile(path, []byte("webhooks:\n  - events: [shutdown]\n"), 0644)
+	if _, err = LoadWebhooksConfig(path); err == nil {
+		t.Error("webhooks need a url")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	var (
+		mu       sync.Mutex
+		bodies   []string
+		attempts int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			// Retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, r.Header.Get("Content-Type")+" "+string(body))
+	}))
+	defer server.Close()
+
+	all := &Webhook{URL: server.URL, Events: []string{LIFECYCLE_PROCESS_FAILED, LIFECYCLE_SHUTDOWN}}
+	text := &Webhook{URL: server.URL + "/text", Events: []string{LIFECYCLE_SHUTDOWN}, ContentType: "text/plain", Template: `{{.App}} {{.Type | json}}`}
+	config := &WebhooksConfig{Webhooks: []*Webhook{all, text}}
+
+	// Parses the template like LoadWebhooksConfig
+	dir, err := ioutil.TempDir("", "crank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.json")
+	data, _ := json.Marshal(config)
+	ioutil.WriteFile(path, data, 0644)
+	if config, err = LoadWebhooksConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewWebhookNotifier(config)
+	n.Observe(&LifecycleEvent{Type: LIFECYCLE_PROCESS_READY, App: "api"})
+	n.Observe(&LifecycleEvent{Type: LIFECYCLE_PROCESS_FAILED, App: "api", Code: 2})
+	n.Observe(&LifecycleEvent{Type: LIFECYCLE_SHUTDOWN, App: "api"})
+	n.Close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 3 {
+		t.Fatalf("expected 3 deliveries, got %q", bodies)
+	}
+	joined := strings.Join(bodies, "\n")
+	if strings.Contains(joined, LIFECYCLE_PROCESS_READY) {
+		t.Error("filtered events were sent", joined)
+	}
+	if !strings.Contains(joined, `application/json {"type":"process_failed"`) {
+		t.Error("missing the JSON body", joined)
+	}
+	if !strings.Contains(joined, `text/plain api "shutdown"`) {
+		t.Error("missing the templated body", joined)
+	}
+}
@@ -0,0 +1,150 @@
+// A process for the tests of crank, scripted through its flags. It accepts
+// the connections of the crank socket and answers with its pid.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	readyAfter       time.Duration
+	exitAfter        time.Duration
+	exitCode         int
+	ignoreTerm       bool
+	termDelay        time.Duration
+	extend           time.Duration
+	status           string
+	helperReadyAfter time.Duration
+	extendOnCont     bool
+	envStatus        string
+)
+
+func main() {
+	flag.DurationVar(&readyAfter, "ready-after", 0, "Sends READY=1 after it, never if negative")
+	flag.DurationVar(&exitAfter, "exit-after", -1, "Exits after it, never if negative")
+	flag.IntVar(&exitCode, "code", 0, "Exit code of -exit-after")
+	flag.BoolVar(&ignoreTerm, "ignore-term", false, "Ignores SIGTERM")
+	flag.DurationVar(&termDelay, "term-delay", 0, "Time to exit after SIGTERM")
+	flag.DurationVar(&extend, "extend", 0, "Sends EXTEND_TIMEOUT_USEC with it when starting")
+	flag.StringVar(&status, "status", "", "Sends STATUS= with it when starting")
+	flag.BoolVar(&extendOnCont, "extend-on-cont", false, "Sends -extend again on SIGCONT, then STATUS=continued")
+	flag.StringVar(&envStatus, "env-status", "", "Sends STATUS= with the values of this variable in its environment when starting")
+	flag.DurationVar(&helperReadyAfter, "helper-ready-after", -1, "Has another process send READY=1 after it, even if this one is stopped")
+	flag.Parse()
+
+	terms := make(chan os.Signal, 1)
+	signal.Notify(terms, syscall.SIGTERM)
+
+	notify := notifier()
+	if extend > 0 {
+		notify("EXTEND_TIMEOUT_USEC=" + strconv.FormatInt(int64(extend/time.Microsecond), 10))
+	}
+	// Last so that the tests can wait for it
+	if status != "" {
+		notify("STATUS=" + status)
+	}
+	if envStatus != "" {
+		var values []string
+		for _, kv := range os.Environ() {
+			if strings.HasPrefix(kv, envStatus+"=") {
+				values = append(values, kv[len(envStatus)+1:])
+			}
+		}
+		notify("STATUS=" + strings.Join(values, ","))
+	}
+	if extendOnCont {
+		conts := make(chan os.Signal, 1)
+		signal.Notify(conts, syscall.SIGCONT)
+		go func() {
+			for range conts {
+				notify("EXTEND_TIMEOUT_USEC=" + strconv.FormatInt(int64(extend/time.Microsecond), 10))
+				notify("STATUS=continued")
+			}
+		}()
+	}
+	if readyAfter >= 0 {
+		time.AfterFunc(readyAfter, func() { notify("READY=1") })
+	}
+	if exitAfter >= 0 {
+		time.AfterFunc(exitAfter, func() { os.Exit(exitCode) })
+	}
+	if helperReadyAfter >= 0 {
+		startHelper()
+		notify("STATUS=helper started")
+	}
+
+	go serve()
+
+	for range terms {
+		if !ignoreTerm {
+			time.Sleep(termDelay)
+			os.Exit(0)
+		}
+	}
+}
+
+// Returns a function sending sd_notify messages to crank, if any
+func notifier() func(string) {
+	fd, err := strconv.Atoi(os.Getenv("NOTIFY_FD"))
+	if err != nil {
+		return func(string) {}
+	}
+	conn, err := net.FileConn(os.NewFile(uintptr(fd), "notify"))
+	if err != nil {
+		fail(err)
+	}
+	return func(message string) {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// Starts a copy of this program sharing the notify socket, which sends
+// READY=1 after -helper-ready-after and exits. The child then sends
+// STATUS=helper started.
+func startHelper() {
+	fd, err := strconv.Atoi(os.Getenv("NOTIFY_FD"))
+	if err != nil {
+		fail(err)
+	}
+	helper := exec.Command(os.Args[0], "-ready-after", helperReadyAfter.String(), "-exit-after", (helperReadyAfter + time.Second).String())
+	helper.Env = []string{"NOTIFY_FD=3"}
+	helper.ExtraFiles = []*os.File{os.NewFile(uintptr(fd), "notify")}
+	if err = helper.Start(); err != nil {
+		fail(err)
+	}
+	go helper.Wait()
+}
+
+func serve() {
+	if os.Getenv("LISTEN_FDS") == "" {
+		return
+	}
+	listener, err := net.FileListener(os.NewFile(3, "listener"))
+	if err != nil {
+		fail(err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Fprintln(conn, os.Getpid())
+		conn.Close()
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "child:", err)
+	os.Exit(100)
+}
@@ -0,0 +1,90 @@
+package cranktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+)
+
+// FakeClock is a crank.Clock that only moves forward with Advance
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.now
+}
+
+func (self *FakeClock) NewTimer(d time.Duration) crank.ClockTimer {
+	t := &fakeTimer{clock: self, c: make(chan time.Time, 1)}
+	self.mutex.Lock()
+	self.timers = append(self.timers, t)
+	t.reset(self.now.Add(d))
+	self.mutex.Unlock()
+	return t
+}
+
+// Moves the time forward and fires the timers that are due
+func (self *FakeClock) Advance(d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.now = self.now.Add(d)
+	for _, t := range self.timers {
+		t.fireIfDue()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(deadline time.Time) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.reset(deadline)
+}
+
+// Must hold the clock's mutex
+func (t *fakeTimer) reset(deadline time.Time) bool {
+	active := t.active
+	t.active = true
+	t.deadline = deadline
+	t.fireIfDue()
+	return active
+}
+
+// Must hold the clock's mutex
+func (t *fakeTimer) fireIfDue() {
+	if !t.active || t.deadline.After(t.clock.now) {
+		return
+	}
+	t.active = false
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
@@ -0,0 +1,313 @@
+// Package cranktest runs a crank Manager in tests. Its start and stop
+// timeouts follow a FakeClock and its processes are a scriptable child
+// binary, see Child. The test binary needs to build the child first:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(cranktest.Main(m))
+//	}
+package cranktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pusher/crank/src/crank"
+	"github.com/pusher/crank/src/netutil"
+)
+
+const (
+	CHILD_PACKAGE = "github.com/pusher/crank/src/cranktest/child"
+	CRANK_PACKAGE = "github.com/pusher/crank/cmd/crank"
+)
+
+// How long the helpers wait for something to happen before failing the test
+var WaitTimeout = 10 * time.Second
+
+var childPath string
+
+// Builds the child, runs the tests and removes the child. Returns the exit
+// code for os.Exit.
+func Main(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "cranktest")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	if childPath, err = BuildChild(dir); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not build the test child:", err)
+		return 1
+	}
+	return m.Run()
+}
+
+// Builds the child into dir and returns its path
+func BuildChild(dir string) (string, error) {
+	return build(dir, "child", CHILD_PACKAGE)
+}
+
+// Builds crank into dir and returns its path, for the tests that need a
+// whole crank like the upgrade ones
+func BuildCrank(dir string) (string, error) {
+	return build(dir, "crank", CRANK_PACKAGE)
+}
+
+func build(dir, name, pkg string) (string, error) {
+	path := filepath.Join(dir, name)
+	cmd := exec.Command("go", "build", "-o", path, pkg)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return path, cmd.Run()
+}
+
+// Returns the command running the child with the given flags:
+//
+//	-ready-after DURATION  sends READY=1 after it, never if negative (0)
+//	-exit-after DURATION   exits after it, never if negative (-1)
+//	-code N                exit code of -exit-after (0)
+//	-ignore-term           ignores SIGTERM
+//	-term-delay DURATION   time to exit after SIGTERM (0)
+//	-extend DURATION       sends EXTEND_TIMEOUT_USEC with it when starting
+//	-status STRING         sends STATUS= with it when starting, after -extend
+//	-env-status NAME       sends STATUS= with the values of NAME in its
+//	                       environment, joined with commas, when starting
+//	-extend-on-cont        sends -extend again on SIGCONT, then
+//	                       STATUS=continued
+//	-helper-ready-after DURATION
+//	                       has a helper process send READY=1 after it, even
+//	                       while the child is paused, then sends
+//	                       STATUS=helper started
+func Child(args ...string) []string {
+	if childPath == "" {
+		panic("cranktest: the child isn't built, call cranktest.Main from TestMain")
+	}
+	return append([]string{childPath}, args...)
+}
+
+// Harness runs a Manager with its API. The RPC calls go through a real
+// net/rpc connection like crankctl's.
+type Harness struct {
+	t       testing.TB
+	Dir     string
+	Clock   *FakeClock
+	Manager *crank.Manager
+	Client  *rpc.Client
+	Addr    net.Addr // of the socket shared with the processes
+	Ctl     string   // URI of the control socket, like crankctl's -ctl
+
+	socket  *os.File
+	events  chan *crank.LifecycleEvent
+	stopped chan struct{}
+}
+
+// Runs a manager with the config, which starts its first process right
+// away. It's shut down at the end of the test.
+func New(t testing.TB, config *crank.ProcessConfig) *Harness {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cranktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Harness{
+		t:       t,
+		Dir:     dir,
+		Clock:   NewFakeClock(),
+		events:  make(chan *crank.LifecycleEvent, 1000),
+		stopped: make(chan struct{}),
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "app.json")
+	if err = ioutil.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.socket, err = netutil.BindURI("tcp://127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.socket.Close() })
+	listener, err := net.FileListener(h.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Addr = listener.Addr()
+	listener.Close()
+
+	if h.Manager, err = crank.NewManager("", configPath, crank.DEFAULT_CONFIG_HISTORY, h.socket); err != nil {
+		t.Fatal(err)
+	}
+	h.Manager.SetClock(h.Clock)
+	h.Manager.Observe(func(event *crank.LifecycleEvent) {
+		select {
+		case h.events <- event:
+		default:
+			t.Errorf("Dropped %s, too many events", event)
+		}
+	})
+
+	supervisor := crank.NewSupervisor("test")
+	supervisor.Add("", h.Addr.String(), h.Manager)
+	server := crank.NewRPCServer(supervisor, nil)
+	ctl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctl.Close() })
+	h.Ctl = "tcp://" + ctl.Addr().String()
+	go server.Accept(ctl)
+
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	h.Client = rpc.NewClient(client)
+
+	// Runs before the cleanups above
+	t.Cleanup(h.Close)
+	go func() {
+		defer close(h.stopped)
+		supervisor.Run()
+	}()
+	return h
+}
+
+// Shuts the manager down, killing its processes if they don't stop in time
+func (h *Harness) Close() {
+	select {
+	case <-h.stopped:
+	default:
+		done := h.Go("crank.Shutdown", &crank.ShutdownQuery{Wait: true}, &crank.ShutdownReply{})
+		select {
+		case <-done:
+		case <-time.After(WaitTimeout):
+			h.t.Error("Timed out shutting down")
+			// Escalates to killing the processes and exiting
+			h.Manager.Shutdown()
+			h.Manager.Shutdown()
+		}
+		<-h.stopped
+	}
+	h.Client.Close()
+}
+
+// Calls an API method, eg "crank.Run", and fails the test on error
+func (h *Harness) Call(method string, query interface{}, reply interface{}) {
+	h.t.Helper()
+	if err := h.Client.Call(method, query, reply); err != nil {
+		h.t.Fatalf("%s: %s", method, err)
+	}
+}
+
+// Calls an API method in the background, for the calls that wait. The
+// result is sent on the returned channel.
+func (h *Harness) Go(method string, query interface{}, reply interface{}) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- h.Client.Call(method, query, reply) }()
+	return done
+}
+
+// Returns the processes of the manager
+func (h *Harness) Ps() []*crank.ProcessInfo {
+	h.t.Helper()
+	var reply crank.PsReply
+	h.Call("crank.Ps", &crank.PsQuery{}, &reply)
+	return reply.PS
+}
+
+// Returns the process of the given pid, or nil if it's gone
+func (h *Harness) Process(pid int) *crank.ProcessInfo {
+	h.t.Helper()
+	for _, pi := range h.Ps() {
+		if pi.Pid == pid {
+			return pi
+		}
+	}
+	return nil
+}
+
+// Waits for the next lifecycle event of the given type, skipping the others
+func (h *Harness) WaitEvent(eventType string) *crank.LifecycleEvent {
+	h.t.Helper()
+	timeout := time.After(WaitTimeout)
+	for {
+		select {
+		case event := <-h.events:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			h.t.Fatalf("Timed out waiting for %s", eventType)
+			return nil
+		}
+	}
+}
+
+// Waits for the process of the given pid to be in the state, eg "READY", or
+// to be gone if state is empty
+func (h *Harness) WaitState(pid int, state string) {
+	h.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		pi := h.Process(pid)
+		if (pi == nil && state == "") || (pi != nil && pi.State == state) {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for pid=%d to be %q, it's %v", pid, state, pi)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Waits for the process of the given pid to report the STATUS= message
+func (h *Harness) WaitStatus(pid int, status string) {
+	h.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		pi := h.Process(pid)
+		if pi != nil && pi.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for pid=%d to report %q, it's %v", pid, status, pi)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Moves the fake clock of the timeouts forward. The timeouts are set by the
+// time their process_started event is received or a Ps shows the process
+// STOPPING.
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// Connects to the shared socket and returns the pid of the process that
+// answered
+func (h *Harness) Dial() int {
+	h.t.Helper()
+	conn, err := net.DialTimeout(h.Addr.Network(), h.Addr.String(), WaitTimeout)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(WaitTimeout))
+
+	var pid int
+	if _, err = fmt.Fscan(conn, &pid); err != nil {
+		h.t.Fatal(err)
+	}
+	return pid
+}
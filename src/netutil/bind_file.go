@@ -1,8 +1,10 @@
 package netutil
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -11,15 +13,23 @@ import (
 // Utility to open a file on a port, path or file descriptor. Useful to bind
 // but not use a specific socket (so it can be passed onto a child).
 //
-// Similar to net.Listen() except that it accepts a URI
+// Similar to net.Listen() except that it accepts a URI. Socket options can be
+// passed in the query, see socketOptions.
 func BindURI(uri string) (file *os.File, err error) {
-	network, addr, err := uriToAddr(uri)
+	network, addr, query, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseSocketOptions(query)
 	if err != nil {
 		return nil, err
 	}
 
 	switch network {
 	case "fd":
+		if !opts.empty() {
+			return nil, fmt.Errorf("Socket options can't be applied to an inherited fd")
+		}
 		var fd uint64
 		if fd, err = strconv.ParseUint(addr, 10, 8); err != nil {
 			return
@@ -27,6 +37,11 @@ func BindURI(uri string) (file *os.File, err error) {
 		// The file name is arbitrary, here we use the uri
 		file = os.NewFile(uintptr(fd), uri)
 		return
+	case "systemd":
+		if !opts.empty() {
+			return nil, fmt.Errorf("Socket options can't be applied to an inherited fd")
+		}
+		return systemdListener(addr)
 	case "unix", "unixpacket", "unixgram":
 		// In case a previous process didn't cleanup the socket properly.
 		// We prefer of running the risk of having two processes than not being
@@ -41,7 +56,7 @@ func BindURI(uri string) (file *os.File, err error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
 		var listener net.Listener
-		if listener, err = net.Listen(network, addr); err != nil {
+		if listener, err = listenWithOptions(network, addr, opts); err != nil {
 			return
 		}
 		// Closing the listener doesn't affect the file and reversely.
@@ -49,7 +64,7 @@ func BindURI(uri string) (file *os.File, err error) {
 		file, err = listener.(filer).File()
 	case "udp", "udp4", "udp6", "unixgram":
 		var packetconn net.PacketConn
-		if packetconn, err = net.ListenPacket(network, addr); err != nil {
+		if packetconn, err = listenPacketWithOptions(network, addr, opts); err != nil {
 			return
 		}
 		file, err = packetconn.(filer).File()
@@ -61,14 +76,31 @@ func BindURI(uri string) (file *os.File, err error) {
 
 // Like net.Dial but accepts a URI
 func DialURI(uri string) (net.Conn, error) {
+	return DialURIContext(context.Background(), uri)
+}
+
+// Like DialURI but gives up once the context is done
+func DialURIContext(ctx context.Context, uri string) (net.Conn, error) {
 	network, addr, err := uriToAddr(uri)
 	if err != nil {
 		return nil, err
 	}
-	return net.Dial(network, addr)
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
 }
 
+// Splits a URI into the network and address used by BindURI and DialURI
+func ParseURI(uri string) (network, address string, err error) {
+	return uriToAddr(uri)
+}
+
+// The query is ignored
 func uriToAddr(uri string) (network, address string, err error) {
+	network, address, _, err = parseURI(uri)
+	return
+}
+
+func parseURI(uri string) (network, address string, query url.Values, err error) {
 	if len(uri) == 0 {
 		err = fmt.Errorf("Empty uri")
 		return
@@ -91,6 +123,11 @@ func uriToAddr(uri string) (network, address string, err error) {
 	default:
 		err = fmt.Errorf("BUG")
 	}
+
+	if i := strings.Index(address, "?"); i >= 0 {
+		query, err = url.ParseQuery(address[i+1:])
+		address = address[:i]
+	}
 	return
 }
 
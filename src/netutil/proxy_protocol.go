@@ -0,0 +1,70 @@
+package netutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Versions of the PROXY protocol, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	PROXY_V1 = 1
+	PROXY_V2 = 2
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Returns the PROXY protocol header describing a connection from src to dst.
+// Non-TCP addresses are sent as UNKNOWN (v1) or LOCAL (v2).
+func ProxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+
+	var srcIP, dstIP net.IP
+	ipv4 := false
+	if known {
+		srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		ipv4 = srcIP != nil && dstIP != nil
+		if !ipv4 {
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		}
+	}
+
+	switch version {
+	case PROXY_V1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcTCP.Port, dstTCP.Port)), nil
+	case PROXY_V2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		if !known {
+			// Version 2, LOCAL command, no address
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+		// Version 2, PROXY command
+		buf.WriteByte(0x21)
+		if ipv4 {
+			buf.WriteByte(0x11) // TCP over IPv4
+		} else {
+			buf.WriteByte(0x21) // TCP over IPv6
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(&buf, binary.BigEndian, uint16(srcTCP.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dstTCP.Port))
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", version)
+	}
+}
@@ -0,0 +1,49 @@
+package netutil
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+
+	header, err := ProxyHeader(PROXY_V1, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "PROXY TCP4 192.168.0.1 10.0.0.2 56324 443\r\n" {
+		t.Errorf("v1 header: %q", header)
+	}
+
+	header, err = ProxyHeader(PROXY_V1, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2})
+	if err != nil || string(header) != "PROXY TCP6 ::1 ::1 1 2\r\n" {
+		t.Errorf("v1 ipv6 header: %q %v", header, err)
+	}
+
+	header, err = ProxyHeader(PROXY_V2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 168, 0, 1,
+		10, 0, 0, 2,
+		0xdc, 0x04,
+		0x01, 0xbb,
+	)
+	if !bytes.Equal(header, expected) {
+		t.Errorf("v2 header: %x", header)
+	}
+
+	header, err = ProxyHeader(PROXY_V2, &net.UnixAddr{Name: "/tmp/sock"}, dst)
+	if err != nil || len(header) != 16 || header[12] != 0x20 {
+		t.Errorf("v2 local header: %x %v", header, err)
+	}
+
+	if _, err = ProxyHeader(3, src, dst); err == nil {
+		t.Error("version 3 should be rejected")
+	}
+}
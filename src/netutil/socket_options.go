@@ -0,0 +1,226 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Options applied to a bound socket, from the query of its URI. Eg:
+//
+//	tcp://:80?backlog=4096&reuseport=1
+//	unix:///run/app.sock?mode=0660&owner=www:www
+type socketOptions struct {
+	backlog     int  // listen(2) backlog, 0 for the default
+	reusePort   bool // SO_REUSEPORT
+	deferAccept int  // TCP_DEFER_ACCEPT, in seconds
+	fastOpen    int  // TCP_FASTOPEN queue length
+	v6Only      *bool
+	mode        os.FileMode // of unix socket files, 0 to keep the umask's
+	owner       string      // of unix socket files, user[:group]
+}
+
+// Parses the socket options. The extra keys are accepted and left to the
+// caller, any other key is an error.
+func parseSocketOptions(query url.Values, extra ...string) (opts *socketOptions, err error) {
+	opts = new(socketOptions)
+	for key := range query {
+		value := query.Get(key)
+		switch key {
+		case "backlog":
+			opts.backlog, err = strconv.Atoi(value)
+		case "reuseport":
+			opts.reusePort, err = strconv.ParseBool(value)
+		case "defer_accept":
+			opts.deferAccept, err = strconv.Atoi(value)
+		case "fastopen":
+			opts.fastOpen, err = strconv.Atoi(value)
+		case "v6only":
+			var v6Only bool
+			v6Only, err = strconv.ParseBool(value)
+			opts.v6Only = &v6Only
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			if err == nil && mode&^uint64(os.ModePerm) != 0 {
+				err = fmt.Errorf("only the permission bits 0777 can be set")
+			}
+			opts.mode = os.FileMode(mode)
+		case "owner":
+			opts.owner = value
+		default:
+			if !stringIn(key, extra) {
+				return nil, fmt.Errorf("Unknown socket option: %s", key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socket option %s=%s: %s", key, value, err)
+		}
+	}
+	return
+}
+
+func (self *socketOptions) empty() bool {
+	return *self == socketOptions{}
+}
+
+// Checks that the options make sense for the network
+func (self *socketOptions) check(network string) error {
+	stream := network == "tcp" || network == "tcp4" || network == "tcp6"
+	unix := strings.HasPrefix(network, "unix")
+	switch {
+	case !stream && (self.deferAccept > 0 || self.fastOpen > 0):
+		return fmt.Errorf("defer_accept and fastopen are only supported on tcp sockets")
+	case (self.backlog > 0) && (network == "unixgram" || strings.HasPrefix(network, "udp")):
+		return fmt.Errorf("backlog is only supported on stream sockets")
+	case !unix && (self.mode != 0 || self.owner != ""):
+		return fmt.Errorf("mode and owner are only supported on unix sockets")
+	case unix && (self.reusePort || self.v6Only != nil):
+		return fmt.Errorf("reuseport and v6only are not supported on unix sockets")
+	}
+	return nil
+}
+
+// Used as net.ListenConfig.Control, called before the socket is bound
+func (self *socketOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = self.setsockopts(int(fd))
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Serialises the binds changing the umask
+var umaskLock sync.Mutex
+
+// Binds unix sockets that get a mode or owner under a umask only giving
+// access to crank's user, so that nobody else can connect before apply sets
+// them. The umask is process wide, the files created meanwhile get at most
+// 0600.
+func (self *socketOptions) bind(network, addr string, bind func() error) error {
+	if !strings.HasPrefix(network, "unix") || strings.HasPrefix(addr, "@") || (self.mode == 0 && self.owner == "") {
+		return bind()
+	}
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	if self.mode == 0 {
+		// Keep the umask's mode once the owner is set
+		self.mode = os.ModePerm &^ os.FileMode(umask)
+	}
+	return bind()
+}
+
+func listenWithOptions(network, addr string, opts *socketOptions) (listener net.Listener, err error) {
+	if err = opts.check(network); err != nil {
+		return
+	}
+	lc := net.ListenConfig{Control: opts.control}
+	err = opts.bind(network, addr, func() (err error) {
+		listener, err = lc.Listen(context.Background(), network, addr)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if err = opts.apply(listener, addr); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return
+}
+
+func listenPacketWithOptions(network, addr string, opts *socketOptions) (conn net.PacketConn, err error) {
+	if err = opts.check(network); err != nil {
+		return
+	}
+	lc := net.ListenConfig{Control: opts.control}
+	err = opts.bind(network, addr, func() (err error) {
+		conn, err = lc.ListenPacket(context.Background(), network, addr)
+		return
+	})
+	if err != nil {
+		return
+	}
+	if err = opts.apply(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// Applies the options that need the socket to be bound
+func (self *socketOptions) apply(socket interface{}, addr string) (err error) {
+	if self.backlog > 0 {
+		if err = self.relisten(socket.(syscall.Conn)); err != nil {
+			return fmt.Errorf("Could not set the backlog: %s", err)
+		}
+	}
+	// The owner first, so that the mode never applies to crank's group
+	if self.owner != "" {
+		uid, gid, err := lookupOwner(self.owner)
+		if err != nil {
+			return err
+		}
+		if err = os.Chown(addr, uid, gid); err != nil {
+			return err
+		}
+	}
+	if self.mode != 0 {
+		if err = os.Chmod(addr, self.mode); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Resolves user[:group] into ids. The group defaults to the user's.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		if u, err = user.LookupId(parts[0]); err != nil {
+			return
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return
+	}
+
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			if g, err = user.LookupGroupId(parts[1]); err != nil {
+				return 0, 0, err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	return
+}
+
+func stringIn(s string, list []string) bool {
+	for _, t := range list {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package netutil
+
+import (
+	"syscall"
+)
+
+// Missing from the syscall package
+const (
+	soReusePort = 0xf
+	tcpFastOpen = 0x17
+)
+
+func (self *socketOptions) setsockopts(fd int) (err error) {
+	if self.reusePort {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return
+		}
+	}
+	if self.deferAccept > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, self.deferAccept); err != nil {
+			return
+		}
+	}
+	if self.fastOpen > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, self.fastOpen); err != nil {
+			return
+		}
+	}
+	if self.v6Only != nil {
+		v6Only := 0
+		if *self.v6Only {
+			v6Only = 1
+		}
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6Only); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Calling listen(2) again on a listening socket updates its backlog
+func (self *socketOptions) relisten(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), self.backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func (self *socketOptions) setsockopts(fd int) error {
+	if self.reusePort || self.deferAccept > 0 || self.fastOpen > 0 || self.v6Only != nil {
+		return fmt.Errorf("reuseport, defer_accept, fastopen and v6only are only supported on linux")
+	}
+	return nil
+}
+
+func (self *socketOptions) relisten(conn syscall.Conn) error {
+	return fmt.Errorf("backlog is only supported on linux")
+}
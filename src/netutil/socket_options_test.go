@@ -0,0 +1,84 @@
+package netutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestBindURIOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.sock")
+	file, err := BindURI("unix://" + path + "?mode=0640")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModePerm != 0640 {
+		t.Errorf("mode: %v", fi.Mode())
+	}
+
+	// Only the owner keeps the umask's mode, and the umask is restored
+	umask := syscall.Umask(022)
+	defer syscall.Umask(umask)
+	path = filepath.Join(dir, "owned.sock")
+	if file, err = BindURI("unix://" + path + "?owner=" + strconv.Itoa(os.Getuid())); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModePerm != 0755 {
+		t.Errorf("mode: %v", fi.Mode())
+	}
+	if umask = syscall.Umask(022); umask != 022 {
+		t.Errorf("umask: %o", umask)
+	}
+
+	invalid := []string{
+		"tcp://127.0.0.1:0?foo=bar",
+		"tcp://127.0.0.1:0?backlog=many",
+		"tcp://127.0.0.1:0?mode=0600",
+		"unix://" + filepath.Join(dir, "sticky.sock") + "?mode=01777",
+		"udp://127.0.0.1:0?defer_accept=1",
+		"fd://3?backlog=10",
+	}
+	for _, uri := range invalid {
+		if file, err = BindURI(uri); err == nil {
+			file.Close()
+			t.Errorf("%s should be rejected", uri)
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	file, err = BindURI("tcp://127.0.0.1:0?backlog=16&reuseport=1&defer_accept=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reusePort, err := syscall.GetsockoptInt(int(file.Fd()), syscall.SOL_SOCKET, soReusePort)
+	if err != nil || reusePort != 1 {
+		t.Errorf("reuseport: %d %v", reusePort, err)
+	}
+	deferAccept, err := syscall.GetsockoptInt(int(file.Fd()), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT)
+	if err != nil || deferAccept == 0 {
+		t.Errorf("defer_accept: %d %v", deferAccept, err)
+	}
+}
@@ -0,0 +1,87 @@
+package netutil
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// First file descriptor passed by systemd, see sd_listen_fds(3)
+const sdListenFdsStart = 3
+
+var (
+	systemdOnce  sync.Once
+	systemdFiles map[string][]*os.File
+	systemdErr   error
+)
+
+// Returns the socket passed by systemd under the given name, see
+// LISTEN_FDNAMES in sd_listen_fds(3). Sockets without a name are called
+// "unknown" like in systemd.
+//
+// The LISTEN_* variables are read once and removed from the environment so
+// that they don't leak to the processes.
+func systemdListener(name string) (*os.File, error) {
+	TakeSystemdListeners()
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	files := systemdFiles[name]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No socket named %s passed by systemd", name)
+	}
+	// The same name can be used by multiple sockets
+	systemdFiles[name] = files[1:]
+	return files[0], nil
+}
+
+// Takes the sockets passed by systemd, if any, and removes the LISTEN_*
+// variables from the environment. Called at startup so that the variables
+// don't leak to the processes when no systemd:// URI is used.
+func TakeSystemdListeners() {
+	systemdOnce.Do(func() {
+		systemdFiles, systemdErr = listenFds()
+	})
+}
+
+func listenFds() (map[string][]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, fmt.Errorf("Missing or invalid LISTEN_PID, crank was not socket-activated")
+	}
+	if pid != os.Getpid() {
+		return nil, fmt.Errorf("LISTEN_PID=%d is meant for another process", pid)
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS=%s", os.Getenv("LISTEN_FDS"))
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	files := make(map[string][]*os.File)
+	for i := 0; i < count; i++ {
+		fd := sdListenFdsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// Only the processes that are given the socket get it
+		syscall.CloseOnExec(fd)
+		files[name] = append(files[name], os.NewFile(uintptr(fd), "systemd://"+name))
+	}
+	return files, nil
+}
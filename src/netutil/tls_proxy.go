@@ -0,0 +1,184 @@
+package netutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSProxy terminates TLS for processes that can't do it themselves.
+//
+// It accepts the connections of a `tls+tcp://[host]:<port>?cert=PATH&key=PATH`
+// URI and forwards them in plaintext to an internal unix socket, which is the
+// one passed to the processes. With `&proxy=v1` or `&proxy=v2` each forwarded
+// connection starts with a PROXY protocol header carrying the client address.
+// The other socket options apply to the external socket.
+type TLSProxy struct {
+	uri      string
+	certPath string
+	keyPath  string
+	proxy    int
+
+	listener net.Listener
+	internal *net.UnixListener
+	dir      string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// Binds the external and internal sockets
+func NewTLSProxy(uri string) (self *TLSProxy, err error) {
+	network, addr, query, err := parseURI(uri)
+	if err != nil {
+		return
+	}
+	if network != "tls+tcp" {
+		return nil, fmt.Errorf("Unsupported TLS network: %s", network)
+	}
+	opts, err := parseSocketOptions(query, "cert", "key", "proxy")
+	if err != nil {
+		return
+	}
+
+	self = &TLSProxy{
+		uri:      uri,
+		certPath: query.Get("cert"),
+		keyPath:  query.Get("key"),
+	}
+	if self.certPath == "" || self.keyPath == "" {
+		return nil, fmt.Errorf("Missing cert or key in %s", uri)
+	}
+	switch query.Get("proxy") {
+	case "":
+	case "v1":
+		self.proxy = PROXY_V1
+	case "v2":
+		self.proxy = PROXY_V2
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %s", query.Get("proxy"))
+	}
+
+	if err = self.Reload(); err != nil {
+		return nil, err
+	}
+
+	if self.listener, err = listenWithOptions("tcp", addr, opts); err != nil {
+		return nil, err
+	}
+
+	// Only readable by crank's user
+	if self.dir, err = ioutil.TempDir("", "crank-tls"); err != nil {
+		self.listener.Close()
+		return nil, err
+	}
+	internalAddr := &net.UnixAddr{Name: filepath.Join(self.dir, "socket"), Net: "unix"}
+	if self.internal, err = net.ListenUnix("unix", internalAddr); err != nil {
+		self.listener.Close()
+		os.RemoveAll(self.dir)
+		return nil, err
+	}
+	return self, nil
+}
+
+// Returns the internal socket to pass onto the processes
+func (self *TLSProxy) File() (*os.File, error) {
+	return self.internal.File()
+}
+
+// Reloads the certificate and key. The previous ones are kept on error.
+func (self *TLSProxy) Reload() error {
+	cert, err := tls.LoadX509KeyPair(self.certPath, self.keyPath)
+	if err != nil {
+		return fmt.Errorf("Could not load the TLS certificate: %s", err)
+	}
+	self.mu.Lock()
+	self.cert = &cert
+	self.mu.Unlock()
+	return nil
+}
+
+func (self *TLSProxy) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.cert, nil
+}
+
+// Serve accepts and forwards the connections until Close is called
+func (self *TLSProxy) Serve() {
+	config := &tls.Config{
+		GetCertificate: self.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go self.forward(tls.Server(conn, config))
+	}
+}
+
+// Stops accepting new connections. The ones in progress are left alone.
+func (self *TLSProxy) Close() error {
+	err := self.listener.Close()
+	self.internal.Close()
+	os.RemoveAll(self.dir)
+	return err
+}
+
+func (self *TLSProxy) forward(conn *tls.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("[tls] Handshake failed with %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	backend, err := net.DialUnix("unix", nil, self.internal.Addr().(*net.UnixAddr))
+	if err != nil {
+		log.Printf("[tls] Could not forward %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer backend.Close()
+
+	if self.proxy > 0 {
+		header, err := ProxyHeader(self.proxy, conn.RemoteAddr(), conn.LocalAddr())
+		if err == nil {
+			_, err = backend.Write(header)
+		}
+		if err != nil {
+			log.Printf("[tls] Could not send the PROXY header for %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, conn)
+		backend.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
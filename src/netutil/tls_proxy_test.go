@@ -0,0 +1,136 @@
+package netutil
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for name and its key
+func writeTestCert(t *testing.T, certPath, keyPath, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crank-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first.example")
+
+	proxy, err := NewTLSProxy("tls+tcp://127.0.0.1:0?cert=" + certPath + "&key=" + keyPath + "&proxy=v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Serve()
+
+	// The process side, listening on the internal socket like a child would
+	file, err := proxy.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	headers := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				header, _ := r.ReadString('\n')
+				headers <- header
+				line, _ := r.ReadString('\n')
+				conn.Write([]byte(strings.ToUpper(line)))
+			}()
+		}
+	}()
+
+	addr := proxy.listener.Addr().String()
+	roundTrip := func(expectedName string) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expectedName {
+			t.Errorf("served the certificate of %s instead of %s", name, expectedName)
+		}
+		if _, err = conn.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || reply != "HELLO\n" {
+			t.Errorf("unexpected reply %q: %v", reply, err)
+		}
+		header := <-headers
+		if expected := "PROXY TCP4 " + conn.LocalAddr().(*net.TCPAddr).IP.String() + " " + conn.RemoteAddr().(*net.TCPAddr).IP.String() + " "; !strings.HasPrefix(header, expected) {
+			t.Errorf("unexpected PROXY header %q", header)
+		}
+	}
+
+	roundTrip("first.example")
+
+	writeTestCert(t, certPath, keyPath, "second.example")
+	if err = proxy.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip("second.example")
+
+	// A broken key keeps the current certificate
+	if err = ioutil.WriteFile(keyPath, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = proxy.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid key")
+	}
+	roundTrip("second.example")
+}